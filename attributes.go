@@ -0,0 +1,177 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"strings"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// attributeLimiter sets attributes on a span until MaxAttrsPerSpan is reached,
+// after which remaining attributes are dropped and `attrs_truncated` is set
+type attributeLimiter struct {
+	span      trace.Span
+	count     int
+	truncated bool
+}
+
+func newAttributeLimiter(span trace.Span) *attributeLimiter {
+	return &attributeLimiter{span: span}
+}
+
+// attributeMapping renames or drops attribute keys before they are set on spans
+type attributeMapping struct {
+	Rename map[string]string `json:"rename"`
+	Drop   []string          `json:"drop"`
+}
+
+// otelConventions renames attributes to their OpenTelemetry semantic convention
+// names for the VCS and CI/CD domains, for backends like Grafana Tempo which
+// search on conventional names. service.name is always set on the resource.
+var otelConventions = map[string]string{
+	"repo":         "vcs.repository.url.full",
+	"branch":       "vcs.repository.ref.name",
+	"commit":       "vcs.repository.ref.revision",
+	"pipeline":     "cicd.pipeline.name",
+	"build_number": "cicd.pipeline.run.id",
+	"creator_id":   "enduser.id",
+}
+
+// loadAttributeMapping reads an attributeMapping from a JSON file such as:
+//
+//	{"rename": {"commit": "git.commit.sha"}, "drop": ["author"]}
+//
+// With conventions set to "otel", attributes are first renamed by otelConventions,
+// renames of the file taking precedence.
+func loadAttributeMapping(conventions, path string) attributeMapping {
+	var m attributeMapping
+	if conventions == "otel" {
+		m.Rename = make(map[string]string, len(otelConventions))
+		for k, v := range otelConventions {
+			m.Rename[k] = v
+		}
+	}
+	if path == "" {
+		return m
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		log.Fatalf("failed to read attribute mapping: %v\n", err)
+	}
+	var file attributeMapping
+	if err := json.Unmarshal(content, &file); err != nil {
+		log.Fatalf("failed to parse attribute mapping: %v\n", err)
+	}
+
+	if m.Rename == nil {
+		m.Rename = make(map[string]string, len(file.Rename))
+	}
+	for k, v := range file.Rename {
+		m.Rename[k] = v
+	}
+	m.Drop = file.Drop
+
+	return m
+}
+
+// apply returns kvs with dropped keys removed and renamed keys replaced
+func (m attributeMapping) apply(kvs []attribute.KeyValue) []attribute.KeyValue {
+	if len(m.Rename) == 0 && len(m.Drop) == 0 {
+		return kvs
+	}
+
+	result := make([]attribute.KeyValue, 0, len(kvs))
+	for _, kv := range kvs {
+		key := string(kv.Key)
+		if contains(m.Drop, key) {
+			continue
+		}
+		if renamed, ok := m.Rename[key]; ok {
+			kv.Key = attribute.Key(renamed)
+		}
+		result = append(result, kv)
+	}
+
+	return result
+}
+
+// SetAttributes sets kvs on the span within the attribute limit
+func (l *attributeLimiter) SetAttributes(kvs ...attribute.KeyValue) {
+	kvs = AttributeMapping.apply(kvs)
+	if MaxAttrsPerSpan > 0 && l.count+len(kvs) > MaxAttrsPerSpan {
+		kvs = kvs[:MaxAttrsPerSpan-l.count]
+		if !l.truncated {
+			l.truncated = true
+			l.span.SetAttributes(attribute.Bool("attrs_truncated", true))
+		}
+	}
+
+	l.count += len(kvs)
+	l.span.SetAttributes(kvs...)
+}
+
+// SetString sets the attribute only when v is present
+func (l *attributeLimiter) SetString(key string, v *string) {
+	if v != nil {
+		l.SetAttributes(attribute.String(key, *v))
+	}
+}
+
+// SetInt sets the attribute only when v is present
+func (l *attributeLimiter) SetInt(key string, v *int) {
+	if v != nil {
+		l.SetAttributes(attribute.Int(key, *v))
+	}
+}
+
+// SetMetadata flattens the string values of a metadata map into prefixed attributes.
+// Other values are JSON encoded when MetadataJSONFallback is enabled.
+func (l *attributeLimiter) SetMetadata(prefix string, metadata interface{}) {
+	// this cannot be casted directly to map[string]string
+	m, ok := metadata.(map[string]interface{})
+	if !ok {
+		return
+	}
+
+	for k, v := range m {
+		// an empty key would produce a bare prefix attribute
+		if k == "" {
+			continue
+		}
+		switch val := v.(type) {
+		case string:
+			l.SetAttributes(attribute.String(prefix+k, val))
+		case nil:
+		default:
+			if !MetadataJSONFallback {
+				continue
+			}
+			encoded, err := json.Marshal(val)
+			if err != nil {
+				continue
+			}
+			l.SetAttributes(attribute.String(prefix+k, truncate(string(encoded), MetadataMaxLength)))
+		}
+	}
+}
+
+// SetKeyValues flattens a list of "key<sep>value" strings into prefixed attributes,
+// splitting on the first separator and skipping entries that are not kv pairs
+// or have an empty key
+func (l *attributeLimiter) SetKeyValues(prefix, sep string, kvs []string) {
+	if sep == "" {
+		return
+	}
+
+	for _, kv := range kvs {
+		token := strings.SplitN(kv, sep, 2)
+		if len(token) != 2 || strings.TrimSpace(token[0]) == "" {
+			continue
+		}
+		l.SetAttributes(attribute.String(prefix+token[0], token[1]))
+	}
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// recordAttributes returns the attributes set by set on a span, by key
+func recordAttributes(t *testing.T, set func(l *attributeLimiter)) map[string]interface{} {
+	t.Helper()
+
+	exporter := tracetest.NewInMemoryExporter()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	defer provider.Shutdown(context.Background())
+
+	_, span := provider.Tracer("test").Start(context.Background(), "test")
+	set(newAttributeLimiter(span))
+	span.End()
+
+	attrs := make(map[string]interface{})
+	for _, kv := range exporter.GetSpans()[0].Attributes {
+		attrs[string(kv.Key)] = kv.Value.AsInterface()
+	}
+
+	return attrs
+}
+
+func TestAttributeLimiterSetString(t *testing.T) {
+	empty, value := "", "main"
+
+	tests := []struct {
+		name string
+		v    *string
+		want map[string]interface{}
+	}{
+		{"nil", nil, map[string]interface{}{}},
+		{"empty", &empty, map[string]interface{}{"branch": ""}},
+		{"value", &value, map[string]interface{}{"branch": "main"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := recordAttributes(t, func(l *attributeLimiter) { l.SetString("branch", tt.v) })
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("attributes = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAttributeLimiterSetInt(t *testing.T) {
+	zero, value := 0, 127
+
+	tests := []struct {
+		name string
+		v    *int
+		want map[string]interface{}
+	}{
+		{"nil", nil, map[string]interface{}{}},
+		{"zero", &zero, map[string]interface{}{"exit_status": int64(0)}},
+		{"value", &value, map[string]interface{}{"exit_status": int64(127)}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := recordAttributes(t, func(l *attributeLimiter) { l.SetInt("exit_status", tt.v) })
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("attributes = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAttributeLimiterSetMetadata(t *testing.T) {
+	tests := []struct {
+		name         string
+		metadata     interface{}
+		jsonFallback bool
+		want         map[string]interface{}
+	}{
+		{"nil", nil, false, map[string]interface{}{}},
+		{"not a map", []string{"a"}, false, map[string]interface{}{}},
+		{"strings", map[string]interface{}{"release": "v1", "env": ""}, false, map[string]interface{}{"build_release": "v1", "build_env": ""}},
+		{"empty key", map[string]interface{}{"": "v1"}, false, map[string]interface{}{}},
+		{"nil value", map[string]interface{}{"release": nil}, true, map[string]interface{}{}},
+		{"non-string without fallback", map[string]interface{}{"shards": 4.0}, false, map[string]interface{}{}},
+		{"non-string with fallback", map[string]interface{}{"shards": 4.0, "tags": []interface{}{"a", "b"}}, true, map[string]interface{}{"build_shards": "4", "build_tags": `["a","b"]`}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fallback := MetadataJSONFallback
+			MetadataJSONFallback = tt.jsonFallback
+			defer func() { MetadataJSONFallback = fallback }()
+
+			got := recordAttributes(t, func(l *attributeLimiter) { l.SetMetadata("build_", tt.metadata) })
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("attributes = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAttributeLimiterSetKeyValues(t *testing.T) {
+	tests := []struct {
+		name string
+		sep  string
+		kvs  []string
+		want map[string]interface{}
+	}{
+		{"nil", "=", nil, map[string]interface{}{}},
+		{"pairs", "=", []string{"queue=default", "os=linux"}, map[string]interface{}{"agent_queue": "default", "agent_os": "linux"}},
+		{"empty value", "=", []string{"queue="}, map[string]interface{}{"agent_queue": ""}},
+		{"no separator", "=", []string{"queue"}, map[string]interface{}{}},
+		{"empty key", "=", []string{"=default", " =default"}, map[string]interface{}{}},
+		{"other separator", ":", []string{"queue:default", "os=linux"}, map[string]interface{}{"agent_queue": "default"}},
+		{"empty separator", "", []string{"queue=default"}, map[string]interface{}{}},
+		{"embedded separator", "=", []string{"env=FOO=bar", "args=a=b=c"}, map[string]interface{}{"agent_env": "FOO=bar", "agent_args": "a=b=c"}},
+		{"embedded multi-char separator", "::", []string{"image::repo::tag"}, map[string]interface{}{"agent_image": "repo::tag"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := recordAttributes(t, func(l *attributeLimiter) { l.SetKeyValues("agent_", tt.sep, tt.kvs) })
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("attributes = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAttributeLimiterMaxAttrsPerSpan(t *testing.T) {
+	limit := MaxAttrsPerSpan
+	MaxAttrsPerSpan = 2
+	defer func() { MaxAttrsPerSpan = limit }()
+
+	a, b, c := "a", "b", "c"
+	got := recordAttributes(t, func(l *attributeLimiter) {
+		l.SetString("a", &a)
+		l.SetString("b", &b)
+		l.SetString("c", &c)
+	})
+
+	want := map[string]interface{}{"a": "a", "b": "b", "attrs_truncated": true}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("attributes = %v, want %v", got, want)
+	}
+}
+
+func FuzzParseAgentMetadata(f *testing.F) {
+	f.Add("queue=default", "=")
+	f.Add("env=FOO=bar", "=")
+	f.Add("=default", "=")
+	f.Add("queue", "=")
+	f.Add("image::repo::tag", "::")
+	f.Add("", "")
+
+	f.Fuzz(func(t *testing.T, kv, sep string) {
+		got := recordAttributes(t, func(l *attributeLimiter) { l.SetKeyValues("agent_", sep, []string{kv}) })
+		if len(got) > 1 {
+			t.Fatalf("one entry set %d attributes: %v", len(got), got)
+		}
+
+		for key, value := range got {
+			k := strings.TrimPrefix(key, "agent_")
+			if k == key || strings.TrimSpace(k) == "" {
+				t.Fatalf("attribute key %q has no prefix or is empty", key)
+			}
+			if k+sep+value.(string) != kv {
+				t.Fatalf("attribute %s=%q does not split %q on %q", key, value, kv, sep)
+			}
+			if strings.Contains(k, sep) {
+				t.Fatalf("attribute key %q holds the separator %q", k, sep)
+			}
+		}
+	})
+}
+
+func FuzzBuildMetadata(f *testing.F) {
+	f.Add("release", `"v1"`)
+	f.Add("shards", `4`)
+	f.Add("tags", `["a", "b"]`)
+	f.Add("nested", `{"a": {"b": null}}`)
+	f.Add("", `"v1"`)
+	f.Add("release", `null`)
+
+	fallback := MetadataJSONFallback
+	MetadataJSONFallback = true
+	defer func() { MetadataJSONFallback = fallback }()
+
+	f.Fuzz(func(t *testing.T, key, value string) {
+		var v interface{}
+		if err := json.Unmarshal([]byte(value), &v); err != nil {
+			t.Skip()
+		}
+
+		got := recordAttributes(t, func(l *attributeLimiter) { l.SetMetadata("build_", map[string]interface{}{key: v}) })
+		if key == "" || v == nil {
+			if len(got) != 0 {
+				t.Fatalf("metadata %q=%s set attributes %v", key, value, got)
+			}
+			return
+		}
+
+		attr, ok := got["build_"+key]
+		if !ok || len(got) != 1 {
+			t.Fatalf("metadata %q=%s set attributes %v, want build_%s", key, value, got, key)
+		}
+		s, ok := attr.(string)
+		if !ok {
+			t.Fatalf("attribute build_%s is a %T, want a string", key, attr)
+		}
+		if _, isString := v.(string); !isString && utf8.RuneCountInString(s) > MetadataMaxLength {
+			t.Fatalf("attribute build_%s is %d runes long, over %d", key, utf8.RuneCountInString(s), MetadataMaxLength)
+		}
+	})
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"log"
+	"math"
+	"strings"
+	"sync"
+)
+
+// bloomFilterMagic is the first line of a cache file holding a bloom filter
+const bloomFilterMagic = "bloom-filter-v1"
+
+// bloomFilter is a fixed-size probabilistic set of build IDs.
+//
+// Memory stays bounded by its capacity, at the cost of Add reporting some new builds
+// as already present. Those builds are skipped and never exported. The false positive
+// rate grows once more builds than the capacity were added.
+type bloomFilter struct {
+	mu     sync.Mutex
+	bits   []uint64
+	hashes uint64
+	count  int
+}
+
+// newBloomFilter sizes a bloom filter for capacity IDs at the false positive rate
+func newBloomFilter(capacity int, falsePositive float64) *bloomFilter {
+	if capacity <= 0 || falsePositive <= 0 || falsePositive >= 1 {
+		log.Fatalf("invalid bloom filter capacity %d or false positive rate %g\n", capacity, falsePositive)
+	}
+
+	m := math.Ceil(-float64(capacity) * math.Log(falsePositive) / (math.Ln2 * math.Ln2))
+	k := math.Max(1, math.Round(m/float64(capacity)*math.Ln2))
+
+	return &bloomFilter{
+		bits:   make([]uint64, (uint64(m)+63)/64),
+		hashes: uint64(k),
+	}
+}
+
+// positions returns the bit positions of id using double hashing
+func (f *bloomFilter) positions(id string) []uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(id))
+	h1 := h.Sum64()
+	h2 := h1>>33 | h1<<31 | 1
+
+	size := uint64(len(f.bits)) * 64
+	result := make([]uint64, f.hashes)
+	for i := range result {
+		result[i] = (h1 + uint64(i)*h2) % size
+	}
+
+	return result
+}
+
+// Add adds id to the filter, returning false when it was probably already present
+func (f *bloomFilter) Add(id string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	added := false
+	for _, p := range f.positions(id) {
+		if f.bits[p/64]&(1<<(p%64)) == 0 {
+			f.bits[p/64] |= 1 << (p % 64)
+			added = true
+		}
+	}
+	if added {
+		f.count++
+	}
+
+	return added
+}
+
+// Has reports whether id was probably added to the filter
+func (f *bloomFilter) Has(id string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for _, p := range f.positions(id) {
+		if f.bits[p/64]&(1<<(p%64)) == 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Len returns the number of IDs added to the filter
+func (f *bloomFilter) Len() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.count
+}
+
+// writeTo writes the magic line, the ID count and hash count, then the bits
+func (f *bloomFilter) writeTo(w *bufio.Writer) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if _, err := fmt.Fprintf(w, "%s\n%d %d %d\n", bloomFilterMagic, f.count, f.hashes, len(f.bits)); err != nil {
+		return fmt.Errorf("error writing cache: %v", err)
+	}
+	if err := binary.Write(w, binary.LittleEndian, f.bits); err != nil {
+		return fmt.Errorf("error writing cache: %v", err)
+	}
+
+	return nil
+}
+
+// readFrom loads a filter written by writeTo. A cache file of build IDs is added to
+// the filter line by line instead, so that an existing cache could be migrated.
+// A filter of a different size is discarded as its bits cannot be mapped.
+func (f *bloomFilter) readFrom(r *bufio.Reader) error {
+	first, err := r.ReadString('\n')
+	if err == io.EOF && first == "" {
+		return nil
+	}
+	if err != nil && err != io.EOF {
+		return fmt.Errorf("error reading cache: %v", err)
+	}
+
+	if strings.TrimSpace(first) != bloomFilterMagic {
+		for line := first; line != ""; line, err = r.ReadString('\n') {
+			if id := strings.TrimSpace(line); id != "" {
+				f.Add(id)
+			}
+			if err != nil {
+				break
+			}
+		}
+		if err != nil && err != io.EOF {
+			return fmt.Errorf("error reading cache: %v", err)
+		}
+		return nil
+	}
+
+	var count, words int
+	var hashes uint64
+	if _, err := fmt.Fscanf(r, "%d %d %d\n", &count, &hashes, &words); err != nil {
+		return fmt.Errorf("error reading bloom filter header: %v", err)
+	}
+	if hashes != f.hashes || words != len(f.bits) {
+		return fmt.Errorf("bloom filter in cache was sized for a different capacity, reset the cache")
+	}
+	if err := binary.Read(r, binary.LittleEndian, f.bits); err != nil {
+		return fmt.Errorf("error reading bloom filter: %v", err)
+	}
+	f.count = count
+
+	return nil
+}
@@ -4,38 +4,134 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"net/url"
+	"runtime/debug"
+	"strings"
+	"time"
 
 	"github.com/buildkite/go-buildkite/v3/buildkite"
 	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/baggage"
 	"go.opentelemetry.io/otel/codes"
 	"go.opentelemetry.io/otel/trace"
 )
 
 func (d *daemon) processBuild(ctx context.Context, b buildkite.Build) {
 	defer d.wg.Done()
+	// one bad build must not crash the daemon, it is dead lettered instead.
+	// Recorded before Done so that the backfill's final checkpoint includes the build.
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("panic processing build %s: %v\n%s", buildName(b), r, debug.Stack())
+			recordDeadLetter(b, fmt.Errorf("panic: %v", r))
+			return
+		}
+		d.checkpoint.record(b)
+	}()
+
+	key := buildName(b)
+	if b.Pipeline != nil && b.Pipeline.Slug != nil {
+		key = *b.Pipeline.Slug + "/" + key
+	}
+	d.inFlight.Store(key, struct{}{})
+	defer d.inFlight.Delete(key)
 
-	log.Printf("processing build %d finished at %s", *b.Number, b.FinishedAt)
+	log.Printf("processing build %s finished at %s", buildName(b), b.FinishedAt)
+
+	// skipped builds never start, record them as zero-duration spans at creation time
+	if b.StartedAt == nil && b.CreatedAt != nil && b.State != nil && isNotRunState(*b.State) {
+		b.StartedAt = b.CreatedAt
+		b.FinishedAt = b.CreatedAt
+	}
 
 	if b.StartedAt == nil || b.FinishedAt == nil {
 		return
 	}
 
-	// create build span
-	buildCtx, buildSpan := d.tracer.Start(ctx, fmt.Sprintf("%d", *b.Number), trace.WithTimestamp(b.StartedAt.Time))
+	// the build is already cached so that short builds are not reconsidered on the next poll.
+	// Clock skewed builds are compared by their clamped duration like their spans.
+	clampedEnd, _ := clampEndTime(b.StartedAt.Time, b.FinishedAt.Time)
+	if duration := clampedEnd.Sub(b.StartedAt.Time); MinBuildDuration > 0 && duration < MinBuildDuration {
+		debugf("Skipping build %s shorter than %s: %s", buildName(b), MinBuildDuration, duration)
+		return
+	}
+
+	// list results omit fields only returned by the single build endpoint. Builds whose
+	// detail could not be fetched are still exported, so they are not dead lettered.
+	fetchDetail := fetchesBuildDetail(b)
+	if !fetchDetail && ListedJobsLimit > 0 && len(b.Jobs) >= ListedJobsLimit {
+		log.Printf("build %s was listed with %d jobs, at LISTED_JOBS_LIMIT, fetching build detail", buildName(b), len(b.Jobs))
+		fetchDetail = true
+	}
+	var detailMissing bool
+	if fetchDetail {
+		if err := d.fetchBuildDetail(ctx, &b); err != nil {
+			log.Printf("error fetching detail of build %s, exporting the listed jobs only: %v", buildName(b), err)
+			detailMissing = true
+		}
+	}
+
+	// job timelines from GraphQL API
+	var timelines map[string]jobTimeline
+	if BuildKiteGraphQLEnabled && b.Number != nil && b.Pipeline != nil && b.Pipeline.Slug != nil {
+		var jobCount int
+		var err error
+		callCtx, end := d.tracer.startCall(selfContext(ctx), "GraphQL", BuildKiteRequestTimeout, attribute.String("query", "job_timelines"))
+		timelines, jobCount, err = fetchJobTimelines(callCtx, *b.Pipeline.Slug, *b.Number)
+		end(err)
+		if err != nil {
+			log.Printf("error fetching job timelines for build %s: %v", buildName(b), err)
+		}
+
+		// list results could carry a truncated job list, fetch the rest from build detail
+		if jobCount > len(b.Jobs) && !fetchDetail {
+			log.Printf("build %s has %d jobs but only %d were listed, fetching build detail", buildName(b), jobCount, len(b.Jobs))
+			if err := d.fetchBuildDetail(ctx, &b); err != nil {
+				log.Printf("error fetching detail of build %s, exporting the listed jobs only: %v", buildName(b), err)
+				detailMissing = true
+			}
+		}
+	}
+
+	// after fetching details so that jobs missing from list results are considered
+	if FailuresOnly && !isUnhealthy(b) {
+		debugf("Skipping healthy build: %s", buildName(b))
+		return
+	}
+
+	// propagate build identity to child spans
+	ctx = withBuildBaggage(ctx, b)
+
+	// create build span on the tracer of the pipeline's dataset
+	pipeline := ""
+	if b.Pipeline != nil && b.Pipeline.Slug != nil {
+		pipeline = *b.Pipeline.Slug
+	}
+	tracer := d.tracer.Tracer(pipeline)
+	buildCtx, buildSpan := tracer.Start(ctx, buildName(b), trace.WithTimestamp(b.StartedAt.Time), trace.WithSpanKind(BuildSpanKind))
+	attrs := newAttributeLimiter(buildSpan)
 
 	// build timing
 	// reference: https://buildkite.com/docs/apis/rest-api/builds#timestamp-attributes
-	if b.ScheduledAt != nil {
-		buildSpan.SetAttributes(attribute.Int64("schedule_duration_ms", b.CreatedAt.Time.Sub(b.ScheduledAt.Time).Milliseconds()))
-		buildSpan.SetAttributes(attribute.Int64("create_duration_ms", b.StartedAt.Time.Sub(b.CreatedAt.Time).Milliseconds()))
+	if b.ScheduledAt != nil && b.CreatedAt != nil {
+		attrs.SetAttributes(attribute.Int64("schedule_duration_ms", b.CreatedAt.Time.Sub(b.ScheduledAt.Time).Milliseconds()))
+		attrs.SetAttributes(attribute.Int64("create_duration_ms", b.StartedAt.Time.Sub(b.CreatedAt.Time).Milliseconds()))
+	}
+
+	// end-to-end latency for SLO tracking
+	if createdAt := firstTimestamp(b.CreatedAt, b.ScheduledAt, b.StartedAt); createdAt != nil {
+		attrs.SetAttributes(attribute.Float64("total_seconds", b.FinishedAt.Time.Sub(createdAt.Time).Seconds()))
 	}
 
 	// build state
 	if b.State != nil {
-		buildSpan.SetAttributes(attribute.String("state", *b.State))
+		attrs.SetAttributes(attribute.String("state", *b.State))
 		switch *b.State {
 		case "failed":
-			buildSpan.SetStatus(codes.Error, *b.State)
+			buildSpan.SetStatus(codes.Error, buildFailureDescription(b))
+			if failed := failedJobs(b); len(failed) > 0 {
+				attrs.SetAttributes(attribute.StringSlice("failed_jobs", failed))
+			}
 		case "passed", "finished":
 			buildSpan.SetStatus(codes.Ok, *b.State)
 		default:
@@ -44,39 +140,334 @@ func (d *daemon) processBuild(ctx context.Context, b buildkite.Build) {
 	}
 
 	// build metadata
-	if b.Commit != nil {
-		buildSpan.SetAttributes(attribute.String("commit", *b.Commit))
+	attrs.SetAttributes(attribute.String("org", BuildKiteOrgName))
+	attrs.SetString("commit", b.Commit)
+	if b.Commit != nil && CommitShortLength > 0 {
+		attrs.SetAttributes(attribute.String("commit_short", truncate(*b.Commit, CommitShortLength)))
+	}
+	if b.Message != nil {
+		attrs.SetAttributes(attribute.String("message", truncate(*b.Message, BuildMessageMaxLength)))
 	}
 	if b.Branch != nil {
-		buildSpan.SetAttributes(attribute.String("branch", *b.Branch))
+		attrs.SetAttributes(attribute.String("branch", *b.Branch))
+
+		if b.Pipeline != nil && b.Pipeline.Slug != nil {
+			defaultBranch, err := d.defaultBranch(ctx, *b.Pipeline.Slug)
+			if err != nil {
+				log.Printf("error getting default branch for build %s: %v", buildName(b), err)
+			} else if defaultBranch != "" {
+				attrs.SetAttributes(attribute.Bool("is_default_branch", *b.Branch == defaultBranch))
+			}
+		}
 	}
 	if b.Author != nil {
-		buildSpan.SetAttributes(attribute.String("author", b.Author.Email))
+		attrs.SetAttributes(attribute.String("author", b.Author.Email))
+	}
+	// the creator's ID is stable across email changes, for per-user dashboards
+	if b.Creator != nil {
+		if b.Creator.ID != "" {
+			attrs.SetAttributes(attribute.String("creator_id", b.Creator.ID))
+		}
+		if b.Creator.AvatarURL != "" {
+			attrs.SetAttributes(attribute.String("creator_avatar_url", b.Creator.AvatarURL))
+		}
 	}
-	if b.WebURL != nil {
-		buildSpan.SetAttributes(attribute.String("url", *b.WebURL))
+	attrs.SetString("url", b.WebURL)
+	if b.Pipeline != nil && b.Pipeline.Slug != nil {
+		repo, err := d.repository(ctx, *b.Pipeline.Slug)
+		if err != nil {
+			log.Printf("error getting repository for build %s: %v", buildName(b), err)
+		} else if repo != "" {
+			attrs.SetAttributes(attribute.String("repo", repo))
+		}
+	}
+
+	// stable pipeline identity, slugs and names change when pipelines are renamed
+	if b.Pipeline != nil && b.Pipeline.Slug != nil {
+		id, err := d.pipelineID(ctx, *b.Pipeline.Slug)
+		if err != nil {
+			log.Printf("error getting ID of pipeline for build %s: %v", buildName(b), err)
+		} else if id != "" {
+			attrs.SetAttributes(attribute.String("pipeline_id", id))
+		}
+	}
+
+	// owning team for alert routing
+	if b.Pipeline != nil && b.Pipeline.Slug != nil {
+		team, err := d.team(ctx, *b.Pipeline.Slug)
+		if err != nil {
+			log.Printf("error getting team for build %s: %v", buildName(b), err)
+		}
+		if team != "" {
+			attrs.SetAttributes(attribute.String("team", team))
+		}
+	}
+
+	if BuildRebuildMaxDepth > 0 && b.Number != nil && b.Pipeline != nil && b.Pipeline.Slug != nil {
+		depth, err := d.rebuildDepth(ctx, *b.Pipeline.Slug, *b.Number)
+		if err != nil {
+			log.Printf("error walking rebuild chain of build %s: %v", buildName(b), err)
+		}
+		attrs.SetAttributes(attribute.Int("rebuild_depth", depth))
+	}
+
+	// human wait on block steps, e.g. release approvals
+	if hasUnblockedJob(b) && b.Number != nil && b.Pipeline != nil && b.Pipeline.Slug != nil {
+		unblockedAt, err := d.unblockTimes(ctx, *b.Pipeline.Slug, *b.Number)
+		if err != nil {
+			log.Printf("error fetching unblock times of build %s: %v", buildName(b), err)
+		} else {
+			attrs.SetAttributes(attribute.Float64("blocked_seconds", blockedDuration(b.Jobs, unblockedAt).Seconds()))
+		}
 	}
 
 	// TODO: allow filtering metadata keys
-	if b.MetaData != nil {
-		switch m := b.MetaData.(type) {
-		// this cannot be casted directly to map[string]string
-		case map[string]interface{}:
-			for k, v := range m {
-				switch val := v.(type) {
-				case string:
-					buildSpan.SetAttributes(attribute.String("build_"+k, val))
-				default:
-				}
-			}
-		default:
+	attrs.SetMetadata("build_", b.MetaData)
+
+	// env could hold secrets, only allowlisted variables are exported
+	for _, k := range BuildEnvAllowlist {
+		if v, ok := b.Env[k]; ok && v != nil {
+			attrs.SetAttributes(attribute.String("env_"+k, truncate(fmt.Sprint(v), MetadataMaxLength)))
 		}
 	}
 
+	// effective work window of the build, excluding setup overhead before the first job
+	if firstStart, lastFinish, ok := jobWindow(b.Jobs); ok {
+		buildSpan.AddEvent("first_job_started", trace.WithTimestamp(firstStart))
+		buildSpan.AddEvent("last_job_finished", trace.WithTimestamp(lastFinish))
+		attrs.SetAttributes(attribute.Int64("job_window_duration_ms", lastFinish.Sub(firstStart).Milliseconds()))
+	}
+
+	// parallelism across hosts, jobs which never ran have no agent
+	if agents := distinctAgents(b.Jobs); agents > 0 {
+		attrs.SetAttributes(attribute.Int("distinct_agents", agents))
+	}
+
+	// steps which passed on retry, computed before dropping earlier attempts
+	flaky := flakySteps(b.Jobs)
+	if len(flaky) > 0 {
+		attrs.SetAttributes(attribute.Bool("flaky", true))
+	}
+
+	// jobs and metadata could be missing from the listed build
+	if detailMissing {
+		attrs.SetAttributes(attribute.Bool("detail_missing", true))
+	}
+
 	// create job spans
+	jobs := b.Jobs
+	if JobsLatestAttemptOnly {
+		jobs = latestAttempts(jobs)
+	}
+	if MaxJobsPerBuild > 0 && len(jobs) > MaxJobsPerBuild {
+		attrs.SetAttributes(attribute.Bool("jobs_truncated", true), attribute.Int("total_jobs", len(jobs)))
+		jobs = jobs[:MaxJobsPerBuild]
+	}
+	// test counts of each job from the Test Analytics run of the build
+	var tests map[string]testCounts
+	if TestAnalyticsEnabled && b.ID != nil {
+		var err error
+		tests, err = d.jobTestCounts(ctx, *b.ID)
+		if err != nil {
+			log.Printf("error fetching test executions of build %s: %v", buildName(b), err)
+		}
+	}
+	for _, j := range jobs {
+		var timeline jobTimeline
+		var counts *testCounts
+		if j.ID != nil {
+			timeline = timelines[*j.ID]
+			if c, ok := tests[*j.ID]; ok {
+				counts = &c
+			}
+		}
+		d.processJob(buildCtx, tracer, b, j, timeline, counts, j.StepKey != nil && flaky[*j.StepKey])
+	}
+
+	finishedAt, skewed := clampEndTime(b.StartedAt.Time, b.FinishedAt.Time)
+	if skewed {
+		log.Printf("build %s finished at %s before it started at %s, clamping to zero duration", buildName(b), b.FinishedAt, b.StartedAt)
+		buildSpan.SetAttributes(attribute.Bool("clock_skew", true))
+	}
+
+	state := ""
+	if b.State != nil {
+		state = *b.State
+	}
+	recordDuration(ctx, buildDurations, finishedAt.Sub(b.StartedAt.Time),
+		attribute.String("pipeline", pipeline),
+		attribute.String("state", state),
+	)
+	csvExport.WriteBuild(pipeline, b, finishedAt)
+	recordExportLag(ctx, pipeline, b.FinishedAt.Time)
+
+	buildSpan.End(trace.WithTimestamp(finishedAt))
+}
+
+// buildFailureDescription describes which jobs made the build fail,
+// e.g. `failed: job "tests" exit 1`
+func buildFailureDescription(b buildkite.Build) string {
+	var failures []string
 	for _, j := range b.Jobs {
-		d.processJob(buildCtx, *b.ID, j)
+		if isHardFailed(j) {
+			failures = append(failures, "job "+jobFailureDescription(j))
+		}
+	}
+
+	if len(failures) == 0 {
+		return *b.State
+	}
+
+	return *b.State + ": " + strings.Join(failures, ", ")
+}
+
+// failedJobs returns the names of the jobs that made the build fail
+func failedJobs(b buildkite.Build) []string {
+	var names []string
+	for _, j := range b.Jobs {
+		if isHardFailed(j) {
+			names = append(names, jobName(j))
+		}
+	}
+
+	return names
+}
+
+// isHardFailed reports whether the job failed without being allowed to soft fail
+func isHardFailed(j *buildkite.Job) bool {
+	return j.State != nil && *j.State == "failed" && !j.SoftFailed
+}
+
+// fetchesBuildDetail reports whether the build's detail is fetched, either for all
+// builds or for the builds of the pipelines listed in BuildKiteFetchBuildDetailPipelines
+func fetchesBuildDetail(b buildkite.Build) bool {
+	if BuildKiteFetchBuildDetail {
+		return true
+	}
+
+	return b.Pipeline != nil && b.Pipeline.Slug != nil && contains(BuildKiteFetchBuildDetailPipelines, *b.Pipeline.Slug)
+}
+
+// buildName returns the build number, falling back to the build UUID when the
+// number is missing
+func buildName(b buildkite.Build) string {
+	if b.Number == nil {
+		if b.ID == nil {
+			return "unknown"
+		}
+		return *b.ID
+	}
+
+	return fmt.Sprintf("%d", *b.Number)
+}
+
+// isNotRunState reports whether a build in this state finished without running any job
+func isNotRunState(state string) bool {
+	return state == "skipped" || state == "not_run"
+}
+
+// withBuildBaggage attaches the build org, pipeline and number as baggage to ctx
+func withBuildBaggage(ctx context.Context, b buildkite.Build) context.Context {
+	values := map[string]string{
+		"buildkite.org": BuildKiteOrgName,
+	}
+	if b.Number != nil {
+		values["buildkite.build_number"] = fmt.Sprintf("%d", *b.Number)
+	}
+	if b.Pipeline != nil && b.Pipeline.Slug != nil {
+		values["buildkite.pipeline"] = *b.Pipeline.Slug
+	}
+
+	var members []baggage.Member
+	for k, v := range values {
+		m, err := baggage.NewMember(k, url.QueryEscape(v))
+		if err != nil {
+			log.Printf("invalid baggage member %s=%s: %v", k, v, err)
+			continue
+		}
+		members = append(members, m)
+	}
+
+	bag, err := baggage.New(members...)
+	if err != nil {
+		log.Printf("error creating baggage for build %s: %v", buildName(b), err)
+		return ctx
+	}
+
+	return baggage.ContextWithBaggage(ctx, bag)
+}
+
+// distinctAgents returns the number of distinct agents which ran jobs, by agent ID
+// falling back to the agent name
+func distinctAgents(jobs []*buildkite.Job) int {
+	agents := make(map[string]struct{})
+	for _, j := range jobs {
+		for _, id := range []*string{j.Agent.ID, j.Agent.Name} {
+			if id != nil && *id != "" {
+				agents[*id] = struct{}{}
+				break
+			}
+		}
+	}
+
+	return len(agents)
+}
+
+// jobWindow returns the earliest job start and the latest job finish of a build
+func jobWindow(jobs []*buildkite.Job) (time.Time, time.Time, bool) {
+	var firstStart, lastFinish time.Time
+	for _, j := range jobs {
+		if j.StartedAt != nil && (firstStart.IsZero() || j.StartedAt.Time.Before(firstStart)) {
+			firstStart = j.StartedAt.Time
+		}
+		if j.FinishedAt != nil && j.FinishedAt.Time.After(lastFinish) {
+			lastFinish = j.FinishedAt.Time
+		}
+	}
+
+	if firstStart.IsZero() || lastFinish.IsZero() {
+		return firstStart, lastFinish, false
+	}
+
+	return firstStart, lastFinish, true
+}
+
+// firstTimestamp returns the first timestamp that is present
+func firstTimestamp(timestamps ...*buildkite.Timestamp) *buildkite.Timestamp {
+	for _, ts := range timestamps {
+		if ts != nil {
+			return ts
+		}
+	}
+
+	return nil
+}
+
+// buildQueueDuration returns how long a build waited from creation until it started
+func buildQueueDuration(b buildkite.Build) (time.Duration, bool) {
+	if b.CreatedAt == nil || b.StartedAt == nil {
+		return 0, false
+	}
+
+	return b.StartedAt.Time.Sub(b.CreatedAt.Time), true
+}
+
+// clampEndTime returns the end time of a span, clamped to the start time when
+// clock skew made the span end before it started
+func clampEndTime(start, end time.Time) (time.Time, bool) {
+	if end.Before(start) {
+		return start, true
+	}
+
+	return end, false
+}
+
+// truncate shortens s to at most n runes
+func truncate(s string, n int) string {
+	r := []rune(s)
+	if len(r) <= n {
+		return s
 	}
 
-	buildSpan.End(trace.WithTimestamp(b.FinishedAt.Time))
+	return string(r[:n])
 }
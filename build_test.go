@@ -0,0 +1,335 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/buildkite/go-buildkite/v3/buildkite"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// spanAttribute returns the value of the attribute key of span
+func spanAttribute(span tracetest.SpanStub, key string) (attribute.Value, bool) {
+	for _, kv := range span.Attributes {
+		if string(kv.Key) == key {
+			return kv.Value, true
+		}
+	}
+
+	return attribute.Value{}, false
+}
+
+// spanNamed returns the exported span called name
+func spanNamed(t *testing.T, exporter *tracetest.InMemoryExporter, name string) tracetest.SpanStub {
+	t.Helper()
+
+	for _, s := range exporter.GetSpans() {
+		if s.Name == name {
+			return s
+		}
+	}
+	t.Fatalf("no span named %q in %d exported spans", name, len(exporter.GetSpans()))
+
+	return tracetest.SpanStub{}
+}
+
+// exportBuild processes b and waits for its spans to be exported
+func exportBuild(d *daemon, b buildkite.Build) {
+	d.wg.Add(1)
+	d.processBuild(context.Background(), b)
+}
+
+func TestClampEndTime(t *testing.T) {
+	start := time.Date(2022, 2, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name       string
+		end        time.Time
+		want       time.Time
+		wantSkewed bool
+	}{
+		{"after start", start.Add(time.Minute), start.Add(time.Minute), false},
+		{"at start", start, start, false},
+		{"before start", start.Add(-time.Second), start, true},
+		{"zero end", time.Time{}, start, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, skewed := clampEndTime(start, tt.end)
+			if !got.Equal(tt.want) || skewed != tt.wantSkewed {
+				t.Fatalf("clampEndTime(%s, %s) = %s, %t, want %s, %t", start, tt.end, got, skewed, tt.want, tt.wantSkewed)
+			}
+		})
+	}
+}
+
+func TestProcessBuildClockSkew(t *testing.T) {
+	d, exporter := newTestDaemon(t, http.NotFoundHandler())
+
+	start := time.Now().UTC().Truncate(time.Second)
+	b := testBuild("app", "b1", 1, start, start.Add(-time.Minute))
+	jobName, jobState := "tests", "passed"
+	b.Jobs = []*buildkite.Job{{
+		Name:       &jobName,
+		State:      &jobState,
+		StartedAt:  buildkite.NewTimestamp(start.Add(time.Minute)),
+		FinishedAt: buildkite.NewTimestamp(start),
+	}}
+
+	exportBuild(d, b)
+
+	for _, name := range []string{"1", "tests"} {
+		span := spanNamed(t, exporter, name)
+		if span.EndTime.Before(span.StartTime) {
+			t.Errorf("span %s ends at %s before it starts at %s", name, span.EndTime, span.StartTime)
+		}
+		if v, ok := spanAttribute(span, "clock_skew"); !ok || !v.AsBool() {
+			t.Errorf("span %s has no clock_skew=true attribute", name)
+		}
+	}
+}
+
+func TestProcessBuildNoClockSkew(t *testing.T) {
+	d, exporter := newTestDaemon(t, http.NotFoundHandler())
+
+	start := time.Now().UTC().Truncate(time.Second)
+	exportBuild(d, testBuild("app", "b1", 1, start, start.Add(time.Minute)))
+
+	span := spanNamed(t, exporter, "1")
+	if !span.EndTime.Equal(start.Add(time.Minute)) {
+		t.Errorf("span ends at %s, want %s", span.EndTime, start.Add(time.Minute))
+	}
+	if _, ok := spanAttribute(span, "clock_skew"); ok {
+		t.Errorf("span has a clock_skew attribute without clock skew")
+	}
+}
+
+func TestProcessBuildNilNumber(t *testing.T) {
+	d, exporter := newTestDaemon(t, http.NotFoundHandler())
+
+	start := time.Now().UTC().Truncate(time.Second)
+	b := testBuild("app", "0182c7d2-0000-4000-8000-000000000001", 0, start, start.Add(time.Minute))
+	b.Number = nil
+
+	exportBuild(d, b)
+
+	spanNamed(t, exporter, "0182c7d2-0000-4000-8000-000000000001")
+}
+
+func TestBuildName(t *testing.T) {
+	id, number := "0182c7d2-0000-4000-8000-000000000001", 42
+
+	tests := []struct {
+		name string
+		b    buildkite.Build
+		want string
+	}{
+		{"number", buildkite.Build{ID: &id, Number: &number}, "42"},
+		{"nil number", buildkite.Build{ID: &id}, id},
+		{"nil number and ID", buildkite.Build{}, "unknown"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := buildName(tt.b); got != tt.want {
+				t.Fatalf("buildName() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// testJobs returns n passed jobs which ran from start to finish
+func testJobs(n int, start, finish time.Time) []*buildkite.Job {
+	var jobs []*buildkite.Job
+	for i := 0; i < n; i++ {
+		id, name, state := fmt.Sprintf("job-%d", i), fmt.Sprintf("step %d", i), "passed"
+		jobs = append(jobs, &buildkite.Job{
+			ID:         &id,
+			Name:       &name,
+			State:      &state,
+			StartedAt:  buildkite.NewTimestamp(start),
+			FinishedAt: buildkite.NewTimestamp(finish),
+		})
+	}
+
+	return jobs
+}
+
+func TestProcessBuildFetchesTruncatedJobs(t *testing.T) {
+	// GraphQL API counts more jobs than the build list returned
+	graphql := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"data": {"build": {"jobs": {"count": 3, "edges": []}}, "pipeline": {"teams": {"edges": []}}}}`)
+	}))
+	defer graphql.Close()
+
+	enabled, endpoint := BuildKiteGraphQLEnabled, BuildKiteGraphQLEndPoint
+	BuildKiteGraphQLEnabled, BuildKiteGraphQLEndPoint = true, graphql.URL
+	t.Cleanup(func() { BuildKiteGraphQLEnabled, BuildKiteGraphQLEndPoint = enabled, endpoint })
+
+	start := time.Now().UTC().Truncate(time.Second)
+	b := testBuild("app", "b1", 1, start, start.Add(time.Minute))
+	jobs := testJobs(3, start, start.Add(time.Minute))
+	b.Jobs = jobs[:1]
+	api := &fakeBuildKite{
+		builds: map[string][]buildkite.Build{"app": {b}},
+		jobs:   map[string][]*buildkite.Job{"app/1": jobs},
+	}
+	d, exporter := newTestDaemon(t, api)
+
+	exportBuild(d, b)
+
+	for _, j := range jobs {
+		spanNamed(t, exporter, *j.Name)
+	}
+}
+
+func TestProcessBuildJobTestCounts(t *testing.T) {
+	analytics := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v2/analytics/organizations/org/suites/unit/runs/b1/executions" {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprint(w, `[
+			{"test_id": "t1", "job_id": "job-0", "result": "passed"},
+			{"test_id": "t2", "job_id": "job-0", "result": "failed"},
+			{"test_id": "t3", "job_id": "job-0", "result": "failed"},
+			{"test_id": "t3", "job_id": "job-0", "result": "passed"},
+			{"test_id": "t1", "job_id": "job-1", "result": "passed"}
+		]`)
+	}))
+	defer analytics.Close()
+
+	enabled, endpoint, org, suite := TestAnalyticsEnabled, TestAnalyticsEndPoint, BuildKiteOrgName, TestAnalyticsSuite
+	TestAnalyticsEnabled, TestAnalyticsEndPoint, BuildKiteOrgName, TestAnalyticsSuite = true, analytics.URL+"/", "org", "unit"
+	t.Cleanup(func() {
+		TestAnalyticsEnabled, TestAnalyticsEndPoint, BuildKiteOrgName, TestAnalyticsSuite = enabled, endpoint, org, suite
+	})
+
+	d, exporter := newTestDaemon(t, http.NotFoundHandler())
+
+	start := time.Now().UTC().Truncate(time.Second)
+	b := testBuild("app", "b1", 1, start, start.Add(time.Minute))
+	b.Jobs = testJobs(3, start, start.Add(time.Minute))
+
+	exportBuild(d, b)
+
+	want := map[string][3]int64{"step 0": {1, 1, 1}, "step 1": {1, 0, 0}}
+	for _, name := range []string{"step 0", "step 1", "step 2"} {
+		span := spanNamed(t, exporter, name)
+		var got [3]int64
+		var found bool
+		for i, key := range []string{"tests_passed", "tests_failed", "tests_flaky"} {
+			if v, ok := spanAttribute(span, key); ok {
+				got[i], found = v.AsInt64(), true
+			}
+		}
+		if counts, ok := want[name]; found != ok || got != counts {
+			t.Errorf("span %s has test counts %v (set: %t), want %v (set: %t)", name, got, found, counts, ok)
+		}
+	}
+}
+
+func TestProcessBuildDetailMissing(t *testing.T) {
+	fetch := BuildKiteFetchBuildDetail
+	BuildKiteFetchBuildDetail = true
+	t.Cleanup(func() { BuildKiteFetchBuildDetail = fetch })
+
+	d, exporter := newTestDaemon(t, http.NotFoundHandler())
+	deadBefore := deadLetters.Value()
+
+	start := time.Now().UTC().Truncate(time.Second)
+	b := testBuild("app", "b1", 1, start, start.Add(time.Minute))
+	b.Jobs = testJobs(1, start, start.Add(time.Minute))
+
+	exportBuild(d, b)
+
+	span := spanNamed(t, exporter, "1")
+	if v, ok := spanAttribute(span, "detail_missing"); !ok || !v.AsBool() {
+		t.Errorf("build span has no detail_missing=true attribute")
+	}
+	spanNamed(t, exporter, "step 0")
+	if n := deadLetters.Value() - deadBefore; n != 0 {
+		t.Errorf("dead_letters increased by %d for an exported build, want 0", n)
+	}
+}
+
+func TestProcessBuildFetchesJobsAtListedJobsLimit(t *testing.T) {
+	limit := ListedJobsLimit
+	ListedJobsLimit = 2
+	t.Cleanup(func() { ListedJobsLimit = limit })
+
+	start := time.Now().UTC().Truncate(time.Second)
+	b := testBuild("app", "b1", 1, start, start.Add(time.Minute))
+	jobs := testJobs(3, start, start.Add(time.Minute))
+	b.Jobs = jobs[:2]
+	api := &fakeBuildKite{
+		builds: map[string][]buildkite.Build{"app": {b}},
+		jobs:   map[string][]*buildkite.Job{"app/1": jobs},
+	}
+	d, exporter := newTestDaemon(t, api)
+
+	exportBuild(d, b)
+
+	for _, j := range jobs {
+		spanNamed(t, exporter, *j.Name)
+	}
+}
+
+func TestRebuildDepthIsCappedAndLimited(t *testing.T) {
+	var mu sync.Mutex
+	var inFlight, maxInFlight, calls int
+	api := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		inFlight++
+		calls++
+		if inFlight > maxInFlight {
+			maxInFlight = inFlight
+		}
+		mu.Unlock()
+		defer func() {
+			mu.Lock()
+			inFlight--
+			mu.Unlock()
+		}()
+
+		// every build was rebuilt from the previous one
+		parts := strings.Split(r.URL.Path, "/")
+		number, _ := strconv.Atoi(parts[len(parts)-1])
+		time.Sleep(time.Millisecond)
+		fmt.Fprintf(w, `{"rebuilt_from": {"id": "b%d", "number": %d}}`, number-1, number-1)
+	})
+	d, _ := newTestDaemon(t, api)
+	d.apiLimit = make(chan struct{}, 1)
+
+	depth := BuildRebuildMaxDepth
+	BuildRebuildMaxDepth = 1000
+	t.Cleanup(func() { BuildRebuildMaxDepth = depth })
+
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if got, err := d.rebuildDepth(context.Background(), "app", 1000); err != nil || got != rebuildDepthLimit {
+				t.Errorf("rebuildDepth() = %d, %v, want %d", got, err, rebuildDepthLimit)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if calls != 2*rebuildDepthLimit {
+		t.Errorf("API called %d times, want %d", calls, 2*rebuildDepthLimit)
+	}
+	if maxInFlight > 1 {
+		t.Errorf("%d lookups in flight, want at most BUILDKITE_MAX_CONCURRENCY", maxInFlight)
+	}
+}
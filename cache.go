@@ -5,13 +5,32 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"strings"
+	"sync"
 )
 
+// cache persists the IDs of exported builds between runs.
+//
+// The cache file stores one build ID per line. Blank lines and surrounding
+// whitespace are ignored when loading.
+//
+// Build IDs are the UUIDs assigned by BuildKite. Build numbers must not be used
+// as keys as they are only unique within a pipeline and the cache file is shared
+// by all pipelines.
+//
+// With CacheBackend set to "bloom", the file instead stores a bloom filter so that
+// memory stays bounded regardless of the number of builds, see bloomFilter.
+//
+// A cache without fileStore is a no-op cache which never remembers any build.
 type cache struct {
 	fileStore *os.File
 }
 
 func NewCache(cachePath string) *cache {
+	if CacheDisabled {
+		return &cache{}
+	}
+
 	// load cache file on each run
 	f, err := os.OpenFile(cachePath, os.O_RDWR|os.O_CREATE, 0775)
 	if err != nil {
@@ -21,19 +40,113 @@ func NewCache(cachePath string) *cache {
 	return &cache{f}
 }
 
-func (c *cache) loadCache() map[string]struct{} {
-	result := make(map[string]struct{})
-	scanner := bufio.NewScanner(c.fileStore)
-	for scanner.Scan() {
-		result[scanner.Text()] = struct{}{}
+// cacheIsEmpty reports whether no build was ever exported to the cache file, which
+// is missing or empty
+func cacheIsEmpty(cachePath string) bool {
+	info, err := os.Stat(cachePath)
+	if os.IsNotExist(err) {
+		return true
+	}
+	if err != nil {
+		log.Fatalf("could not stat cache file: %v\n", err)
+	}
+
+	return info.Size() == 0
+}
+
+// Close releases the underlying cache file
+func (c *cache) Close() error {
+	if c.fileStore == nil {
+		return nil
+	}
+
+	return c.fileStore.Close()
+}
+
+// buildIDStore remembers the IDs of exported builds, safe for concurrent use by
+// pipeline and build goroutines
+type buildIDStore interface {
+	// Add adds id to the store, returning false when it was already present
+	Add(id string) bool
+	// Has reports whether id is in the store
+	Has(id string) bool
+	// Len returns the number of IDs in the store
+	Len() int
+	// writeTo persists the store in its cache file format
+	writeTo(w *bufio.Writer) error
+}
+
+// loadCache reads the cache file into the store selected by CacheBackend
+func (c *cache) loadCache() buildIDStore {
+	var result buildIDStore
+	switch CacheBackend {
+	case "bloom":
+		result = newBloomFilter(CacheBloomCapacity, CacheBloomFalsePositive)
+	default:
+		result = newBuildIDSet()
+	}
+	if c.fileStore == nil {
+		return result
 	}
 
-	fmt.Printf("loading cache: %d lines\n", len(result))
+	r := bufio.NewReader(c.fileStore)
+	if bloom, ok := result.(*bloomFilter); ok {
+		if err := bloom.readFrom(r); err != nil {
+			log.Fatalf("could not load cache: %v\n", err)
+		}
+	} else {
+		scanner := bufio.NewScanner(r)
+		for scanner.Scan() {
+			id := strings.TrimSpace(scanner.Text())
+			if id == "" {
+				continue
+			}
+			// starting from an empty cache would export every build of the retention window again
+			if id == bloomFilterMagic {
+				log.Fatalf("cache file holds a bloom filter which CACHE_BACKEND=%s cannot read, set CACHE_BACKEND=bloom or run reset-cache\n", CacheBackend)
+			}
+			result.Add(id)
+		}
+	}
+
+	fmt.Printf("loading cache: %d lines\n", result.Len())
 
 	return result
 }
 
-func (c *cache) writeCache(cacheBuildIDs map[string]struct{}) error {
+// writeCacheFile replaces the cache file at cachePath with the store, written aside
+// then renamed so that a crash never leaves a partial cache
+func writeCacheFile(cachePath string, cacheBuildIDs buildIDStore) error {
+	tmp := cachePath + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0775)
+	if err != nil {
+		return fmt.Errorf("error creating cache: %v", err)
+	}
+
+	w := bufio.NewWriter(f)
+	if err := cacheBuildIDs.writeTo(w); err != nil {
+		f.Close()
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return fmt.Errorf("error writing cache: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("error writing cache: %v", err)
+	}
+	if err := os.Rename(tmp, cachePath); err != nil {
+		return fmt.Errorf("error writing cache: %v", err)
+	}
+
+	return nil
+}
+
+func (c *cache) writeCache(cacheBuildIDs buildIDStore) error {
+	if c.fileStore == nil {
+		return nil
+	}
+
 	err := c.fileStore.Truncate(0)
 	if err != nil {
 		return fmt.Errorf("error truncating cache: %v", err)
@@ -44,9 +157,69 @@ func (c *cache) writeCache(cacheBuildIDs map[string]struct{}) error {
 	}
 
 	w := bufio.NewWriter(c.fileStore)
-	defer w.Flush()
+	if err := cacheBuildIDs.writeTo(w); err != nil {
+		return err
+	}
+
+	return w.Flush()
+}
+
+// buildIDSet is a set of build IDs, stored in the cache file as one build ID per line
+type buildIDSet struct {
+	mu  sync.Mutex
+	ids map[string]struct{}
+}
+
+func newBuildIDSet() *buildIDSet {
+	return &buildIDSet{ids: make(map[string]struct{})}
+}
+
+// Add adds id to the set, returning false when it was already present
+func (s *buildIDSet) Add(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.ids[id]; ok {
+		return false
+	}
+	s.ids[id] = struct{}{}
+
+	return true
+}
+
+// Has reports whether id is in the set
+func (s *buildIDSet) Has(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, ok := s.ids[id]
+
+	return ok
+}
+
+// Len returns the number of IDs in the set
+func (s *buildIDSet) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return len(s.ids)
+}
+
+// IDs returns a snapshot of the IDs in the set
+func (s *buildIDSet) IDs() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ids := make([]string, 0, len(s.ids))
+	for id := range s.ids {
+		ids = append(ids, id)
+	}
+
+	return ids
+}
 
-	for k := range cacheBuildIDs {
+func (s *buildIDSet) writeTo(w *bufio.Writer) error {
+	for _, k := range s.IDs() {
 		_, err := w.WriteString(k + "\n")
 		if err != nil {
 			return fmt.Errorf("error writing cache: %v", err)
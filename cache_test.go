@@ -0,0 +1,142 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// loadTestCache returns the sorted IDs of the cache file at path
+func loadTestCache(t *testing.T, path string) []string {
+	t.Helper()
+
+	c := NewCache(path)
+	defer c.Close()
+
+	set, ok := c.loadCache().(*buildIDSet)
+	if !ok {
+		t.Fatalf("CACHE_BACKEND=%s did not load a build ID set", CacheBackend)
+	}
+
+	var ids []string
+	ids = append(ids, set.IDs()...)
+	sort.Strings(ids)
+
+	return ids
+}
+
+func TestCacheRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache")
+
+	want := []string{
+		"0182c7d2-6e2b-4a8c-9d3a-1f0e5b6a7c01",
+		"0182c7d2-6e2b-4a8c-9d3a-1f0e5b6a7c02",
+		"0182c7d2-6e2b-4a8c-9d3a-1f0e5b6a7c03",
+	}
+	ids := newBuildIDSet()
+	for _, id := range want {
+		ids.Add(id)
+	}
+
+	c := NewCache(path)
+	if err := c.writeCache(ids); err != nil {
+		t.Fatalf("writeCache: %v", err)
+	}
+	c.Close()
+
+	if got := loadTestCache(t, path); !reflect.DeepEqual(got, want) {
+		t.Fatalf("loaded %v, want %v", got, want)
+	}
+}
+
+func TestCacheLoad(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    []string
+	}{
+		{"empty file", "", nil},
+		{"trailing newline", "a\nb\n", []string{"a", "b"}},
+		{"no trailing newline", "a\nb", []string{"a", "b"}},
+		{"blank lines", "a\n\n\nb\n\n", []string{"a", "b"}},
+		{"surrounding whitespace", "  a\t\n\tb  \r\n   \n", []string{"a", "b"}},
+		{"duplicates", "a\na\n", []string{"a"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "cache")
+			if err := os.WriteFile(path, []byte(tt.content), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			if got := loadTestCache(t, path); !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("loaded %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCacheMissingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache")
+	if !cacheIsEmpty(path) {
+		t.Fatalf("cacheIsEmpty(%q) = false for a missing file", path)
+	}
+
+	if ids := loadTestCache(t, path); len(ids) != 0 {
+		t.Fatalf("loaded %q from a missing file", ids)
+	}
+}
+
+// TestBuildIDStoreConcurrentAdd adds the same IDs from many goroutines, run with -race
+func TestBuildIDStoreConcurrentAdd(t *testing.T) {
+	const goroutines, ids = 16, 500
+
+	stores := []struct {
+		name  string
+		store buildIDStore
+		// bloom filters could report false positives, so that no Add of an ID succeeds
+		exact bool
+	}{
+		{"set", newBuildIDSet(), true},
+		{"bloom", newBloomFilter(10*ids, 0.001), false},
+	}
+
+	for _, tt := range stores {
+		t.Run(tt.name, func(t *testing.T) {
+			added := make([]int64, ids)
+			var wg sync.WaitGroup
+			for g := 0; g < goroutines; g++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for i := 0; i < ids; i++ {
+						if tt.store.Add(fmt.Sprintf("build-%d", i)) {
+							atomic.AddInt64(&added[i], 1)
+						}
+					}
+				}()
+			}
+			wg.Wait()
+
+			for i, n := range added {
+				if n > 1 || tt.exact && n != 1 {
+					t.Fatalf("build-%d was added %d times", i, n)
+				}
+			}
+			if n := tt.store.Len(); n > ids || tt.exact && n != ids {
+				t.Fatalf("Len() = %d after adding %d IDs", n, ids)
+			}
+			for i := 0; i < ids; i++ {
+				if !tt.store.Has(fmt.Sprintf("build-%d", i)) {
+					t.Fatalf("Has(build-%d) = false after adding it", i)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/buildkite/go-buildkite/v3/buildkite"
+)
+
+// checkpoint persists the progress of a backfill every few exported builds so that
+// a crashed backfill only exports again the builds since the last checkpoint.
+//
+// The cache file is rewritten with the builds exported so far, unlike the cache
+// written at the end of a poll which holds every listed build. The cut off point
+// of each pipeline is also written to the checkpoint file, one
+// "<pipeline> <RFC 3339 time>" per line, see daemon.checkpointCutoffs.
+type checkpoint struct {
+	mu        sync.Mutex
+	cachePath string
+	path      string
+	every     int
+	pending   int
+	exported  buildIDStore
+	cutoffs   func() map[string]time.Time
+}
+
+// newCheckpoint returns a checkpoint written every n exported builds, starting from
+// the builds in the cache file
+func newCheckpoint(cachePath string, n int, cutoffs func() map[string]time.Time) *checkpoint {
+	cache := NewCache(cachePath)
+	defer cache.Close()
+
+	return &checkpoint{
+		cachePath: cachePath,
+		path:      checkpointPath(cachePath),
+		every:     n,
+		exported:  cache.loadCache(),
+		cutoffs:   cutoffs,
+	}
+}
+
+// checkpointPath returns the path of the checkpoint file of the cache file
+func checkpointPath(cachePath string) string {
+	return cachePath + ".checkpoint"
+}
+
+// record marks the build as exported, writing a checkpoint every n builds
+func (c *checkpoint) record(b buildkite.Build) {
+	if c == nil || b.ID == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.exported.Add(*b.ID)
+	c.pending++
+	if c.pending < c.every {
+		return
+	}
+
+	if err := c.write(); err != nil {
+		log.Printf("error writing checkpoint: %v", err)
+		return
+	}
+	c.pending = 0
+}
+
+// write persists the exported builds and cut off points, the caller holds c.mu
+func (c *checkpoint) write() error {
+	if err := writeCacheFile(c.cachePath, c.exported); err != nil {
+		return err
+	}
+
+	var b strings.Builder
+	for pipeline, finishedAt := range c.cutoffs() {
+		fmt.Fprintf(&b, "%s %s\n", pipeline, finishedAt.Format(time.RFC3339Nano))
+	}
+
+	// written aside then renamed so that a crash never leaves a partial checkpoint
+	tmp := c.path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(b.String()), 0644); err != nil {
+		return fmt.Errorf("error writing checkpoint: %v", err)
+	}
+	if err := os.Rename(tmp, c.path); err != nil {
+		return fmt.Errorf("error writing checkpoint: %v", err)
+	}
+
+	debugf("Checkpointed %d exported builds", c.exported.Len())
+
+	return nil
+}
+
+// resume returns the cut off points of the last checkpoint, if any
+func (c *checkpoint) resume() map[string]time.Time {
+	f, err := os.Open(c.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		log.Fatalf("could not open checkpoint file: %v\n", err)
+	}
+	defer f.Close()
+
+	cutoffs := make(map[string]time.Time)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			continue
+		}
+		finishedAt, err := time.Parse(time.RFC3339Nano, fields[1])
+		if err != nil {
+			log.Printf("ignoring invalid checkpoint of pipeline %s: %v", fields[0], err)
+			continue
+		}
+		cutoffs[fields[0]] = finishedAt
+	}
+	if err := scanner.Err(); err != nil {
+		log.Fatalf("could not read checkpoint file: %v\n", err)
+	}
+
+	return cutoffs
+}
+
+// finish writes the builds exported by the backfill to the cache file and removes
+// the checkpoint file, as the backfill no longer needs resuming
+func (c *checkpoint) finish() {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := writeCacheFile(c.cachePath, c.exported); err != nil {
+		log.Fatalf("error writing cache: %v", err)
+	}
+	if err := os.Remove(c.path); err != nil && !os.IsNotExist(err) {
+		log.Printf("error removing checkpoint file: %v", err)
+	}
+}
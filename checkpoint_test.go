@@ -0,0 +1,34 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestCheckpointWritesCutoffsWithoutOrderedProcessing(t *testing.T) {
+	ordered := OrderedProcessing
+	OrderedProcessing = false
+	t.Cleanup(func() { OrderedProcessing = ordered })
+
+	cachePath := filepath.Join(t.TempDir(), "cache")
+	start := time.Now().UTC().Truncate(time.Second)
+	cutoffs := map[string]time.Time{"app": start.Add(-time.Hour)}
+	c := newCheckpoint(cachePath, 1, func() map[string]time.Time { return cutoffs })
+
+	c.record(testBuild("app", "b1", 1, start, start.Add(time.Minute)))
+
+	if got := loadTestCache(t, cachePath); !reflect.DeepEqual(got, []string{"b1"}) {
+		t.Fatalf("cached %q, want the exported build", got)
+	}
+	if got := c.resume(); !reflect.DeepEqual(got, cutoffs) {
+		t.Fatalf("resumed cut off points %v, want %v", got, cutoffs)
+	}
+	for _, path := range []string{cachePath + ".tmp", c.path + ".tmp"} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Fatalf("temporary file %s left behind: %v", path, err)
+		}
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// command is a CLI subcommand with its own flag set
+type command struct {
+	name  string
+	usage string
+	run   func(args []string)
+}
+
+var commands = []command{
+	{"run", "poll BuildKite and export builds continuously (default)", runCmd},
+	{"tail", "poll BuildKite often for builds finished within a short window", tailCmd},
+	{"backfill", "export builds finished since a point in time once, then exit", backfillCmd},
+	{"build", "export a single build ignoring the cache, then exit", buildCmd},
+	{"reset-cache", "forget all exported builds so they are exported again", resetCacheCmd},
+	{"version", "print the exporter version", versionCmd},
+}
+
+// dispatch runs the subcommand named by args[0], defaulting to `run`
+func dispatch(args []string) {
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		// MODE=single is kept as an env var shortcut of the build command
+		if os.Getenv("MODE") == "single" {
+			buildCmd(args)
+			return
+		}
+		if os.Getenv("MODE") == "tail" {
+			tailCmd(args)
+			return
+		}
+		runCmd(args)
+		return
+	}
+
+	for _, c := range commands {
+		if c.name == args[0] {
+			c.run(args[1:])
+			return
+		}
+	}
+
+	fmt.Fprintf(os.Stderr, "unknown command %q\n\n", args[0])
+	usage()
+	os.Exit(2)
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s [command] [flags]\n\nCommands:\n", os.Args[0])
+	for _, c := range commands {
+		fmt.Fprintf(os.Stderr, "  %-12s %s\n", c.name, c.usage)
+	}
+}
+
+// pipelines returns the pipelines to export from BUILDKITE_PIPELINE,
+// pipelines of BUILDKITE_CLUSTER are resolved by the daemon
+func pipelines() []string {
+	return envList("BUILDKITE_PIPELINE")
+}
+
+func runCmd(args []string) {
+	fs := flag.NewFlagSet("run", flag.ExitOnError)
+	sleepDuration := fs.Duration("interval", 15*time.Minute, "time to sleep between polls")
+	fs.StringVar(&ServiceCachePath, "cache-path", ServiceCachePath, "path of the build ID cache file")
+	_ = fs.Parse(args)
+
+	logConfig(pipelines(), *sleepDuration)
+
+	ctx := context.Background()
+	bk := initBuildKiteClient()
+
+	tracer, shutdown := initOtel(ctx, ServiceName)
+	defer shutdown()
+
+	closeCSV := initCSVExport()
+	defer closeCSV()
+
+	serveMetrics(MetricsAddr)
+
+	// in-flight builds are drained and spans flushed before exiting
+	stop, cancel := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	d := NewDaemon(tracer, bk, pipelines(), *sleepDuration, ServiceCachePath)
+	// only on a fresh deploy, a restart still exports the builds finished while the exporter was down
+	if SkipInitialBackfill && cacheIsEmpty(ServiceCachePath) {
+		log.Printf("cache %s is empty, skipping the initial backfill", ServiceCachePath)
+		d.initialFinishedAt = time.Now()
+	}
+	d.Exec(ctx, stop.Done())
+}
+
+func tailCmd(args []string) {
+	fs := flag.NewFlagSet("tail", flag.ExitOnError)
+	sleepDuration := fs.Duration("interval", 30*time.Second, "time to sleep between polls")
+	window := fs.Duration("window", TailWindow, "export builds finished within this duration of each poll")
+	fs.StringVar(&ServiceCachePath, "cache-path", ServiceCachePath, "path of the build ID cache file")
+	_ = fs.Parse(args)
+
+	logConfig(pipelines(), *sleepDuration)
+
+	ctx := context.Background()
+	bk := initBuildKiteClient()
+
+	tracer, shutdown := initOtel(ctx, ServiceName)
+	defer shutdown()
+
+	closeCSV := initCSVExport()
+	defer closeCSV()
+
+	serveMetrics(MetricsAddr)
+
+	// in-flight builds are drained and spans flushed before exiting
+	stop, cancel := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	d := NewDaemon(tracer, bk, pipelines(), *sleepDuration, ServiceCachePath)
+	d.tailWindow = *window
+	d.Exec(ctx, stop.Done())
+}
+
+func backfillCmd(args []string) {
+	fs := flag.NewFlagSet("backfill", flag.ExitOnError)
+	since := fs.Duration("since", HoneycombMaxRetention, "export builds finished within this duration")
+	fs.StringVar(&ServiceCachePath, "cache-path", ServiceCachePath, "path of the build ID cache file")
+	checkpointEvery := fs.Int("checkpoint-every", BackfillCheckpointEvery, "write a checkpoint every this many exported builds, 0 disables checkpoints")
+	_ = fs.Parse(args)
+
+	logConfig(pipelines(), 0)
+
+	ctx := context.Background()
+	bk := initBuildKiteClient()
+
+	tracer, shutdown := initOtel(ctx, ServiceName)
+	defer shutdown()
+
+	closeCSV := initCSVExport()
+	defer closeCSV()
+
+	d := NewDaemon(tracer, bk, pipelines(), 0, ServiceCachePath)
+	d.initialFinishedAt = time.Now().Add(-1 * *since)
+	if *checkpointEvery > 0 && !CacheDisabled {
+		d.checkpoint = newCheckpoint(ServiceCachePath, *checkpointEvery, d.checkpointCutoffs)
+		for pipeline, finishedAt := range d.checkpoint.resume() {
+			log.Printf("pipeline %s: resuming backfill from checkpoint at %s", pipeline, finishedAt)
+			d.advanceFinishedFrom(pipeline, finishedAt)
+		}
+	}
+	d.poll(ctx, nil)
+	d.checkpoint.finish()
+}
+
+func buildCmd(args []string) {
+	fs := flag.NewFlagSet("build", flag.ExitOnError)
+	pipeline := fs.String("pipeline", os.Getenv("PIPELINE"), "slug of the build's pipeline")
+	number := fs.String("number", os.Getenv("BUILD_NUMBER"), "number of the build to export")
+	_ = fs.Parse(args)
+
+	if *pipeline == "" || *number == "" {
+		log.Fatalf("both -pipeline and -number are required\n")
+	}
+
+	ctx := context.Background()
+	bk := initBuildKiteClient()
+
+	tracer, shutdown := initOtel(ctx, ServiceName)
+	defer shutdown()
+
+	closeCSV := initCSVExport()
+	defer closeCSV()
+
+	b, _, err := bk.Builds.Get(BuildKiteOrgName, *pipeline, *number, nil)
+	if err != nil {
+		log.Fatalf("failed to fetch build %s/%s: %v\n", *pipeline, *number, err)
+	}
+
+	d := NewDaemon(tracer, bk, []string{*pipeline}, 0, ServiceCachePath)
+	d.wg.Add(1)
+	d.processBuild(ctx, *b)
+}
+
+func resetCacheCmd(args []string) {
+	fs := flag.NewFlagSet("reset-cache", flag.ExitOnError)
+	fs.StringVar(&ServiceCachePath, "cache-path", ServiceCachePath, "path of the build ID cache file")
+	_ = fs.Parse(args)
+
+	// a backfill checkpoint would resume past the builds the reset is meant to export again
+	for _, path := range []string{ServiceCachePath, checkpointPath(ServiceCachePath)} {
+		err := os.Remove(path)
+		if err != nil && !os.IsNotExist(err) {
+			log.Fatalf("failed to reset cache: %v\n", err)
+		}
+	}
+
+	log.Printf("removed cache %s and its backfill checkpoint", ServiceCachePath)
+}
+
+func versionCmd(args []string) {
+	fs := flag.NewFlagSet("version", flag.ExitOnError)
+	_ = fs.Parse(args)
+
+	fmt.Println(ServiceName, ServiceVersion)
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/buildkite/go-buildkite/v3/buildkite"
+)
+
+var (
+	buildCSVHeader = []string{"pipeline", "number", "branch", "commit", "state", "created_at", "started_at", "finished_at", "queue_seconds", "duration_seconds", "url"}
+	jobCSVHeader   = []string{"pipeline", "build_number", "job", "step_key", "state", "exit_status", "agent", "started_at", "finished_at", "wait_seconds", "duration_seconds"}
+)
+
+// csvExporter appends one row per build or per job to a CSV file, or TSV when the
+// file name ends with .tsv, for spreadsheet users
+type csvExporter struct {
+	mu   sync.Mutex
+	file *os.File
+	w    *csv.Writer
+	jobs bool
+}
+
+// csvExport is set by initCSVExport when ExportCSV is configured
+var csvExport *csvExporter
+
+// initCSVExport opens ExportCSV for appending and returns a function closing it
+func initCSVExport() func() {
+	if ExportCSV == "" {
+		return func() {}
+	}
+
+	f, err := os.OpenFile(ExportCSV, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		log.Fatalf("could not open CSV export file: %v\n", err)
+	}
+
+	e := &csvExporter{file: f, w: csv.NewWriter(f), jobs: ExportCSVRows == "job"}
+	if strings.HasSuffix(ExportCSV, ".tsv") {
+		e.w.Comma = '\t'
+	}
+
+	// only write the header to a new file so that runs append to the same table
+	if info, err := f.Stat(); err == nil && info.Size() == 0 {
+		header := buildCSVHeader
+		if e.jobs {
+			header = jobCSVHeader
+		}
+		e.write(header)
+	}
+
+	csvExport = e
+	return func() {
+		e.mu.Lock()
+		defer e.mu.Unlock()
+
+		e.w.Flush()
+		if err := e.file.Close(); err != nil {
+			log.Printf("error closing CSV export file: %v", err)
+		}
+	}
+}
+
+// write appends a row, flushing it so that rows survive a crash
+func (e *csvExporter) write(row []string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if err := e.w.Write(row); err != nil {
+		log.Printf("error writing CSV row: %v", err)
+		return
+	}
+	e.w.Flush()
+	if err := e.w.Error(); err != nil {
+		log.Printf("error writing CSV row: %v", err)
+	}
+}
+
+// WriteBuild appends the row of a build when exporting builds
+func (e *csvExporter) WriteBuild(pipeline string, b buildkite.Build, finishedAt time.Time) {
+	if e == nil || e.jobs {
+		return
+	}
+
+	queue := ""
+	if d, ok := buildQueueDuration(b); ok {
+		queue = csvSeconds(d)
+	}
+
+	e.write([]string{
+		pipeline,
+		buildName(b),
+		csvString(b.Branch),
+		csvString(b.Commit),
+		csvString(b.State),
+		csvTime(b.CreatedAt),
+		b.StartedAt.Time.Format(time.RFC3339),
+		finishedAt.Format(time.RFC3339),
+		queue,
+		csvSeconds(finishedAt.Sub(b.StartedAt.Time)),
+		csvString(b.WebURL),
+	})
+}
+
+// WriteJob appends the row of a job when exporting jobs
+func (e *csvExporter) WriteJob(pipeline string, b buildkite.Build, j *buildkite.Job, finishedAt time.Time) {
+	if e == nil || !e.jobs {
+		return
+	}
+
+	exitStatus := ""
+	if j.ExitStatus != nil {
+		exitStatus = fmt.Sprintf("%d", *j.ExitStatus)
+	}
+	wait := ""
+	if j.RunnableAt != nil {
+		wait = csvSeconds(j.StartedAt.Time.Sub(j.RunnableAt.Time))
+	}
+
+	e.write([]string{
+		pipeline,
+		buildName(b),
+		jobName(j),
+		csvString(j.StepKey),
+		csvString(j.State),
+		exitStatus,
+		csvString(j.Agent.Name),
+		j.StartedAt.Time.Format(time.RFC3339),
+		finishedAt.Format(time.RFC3339),
+		wait,
+		csvSeconds(finishedAt.Sub(j.StartedAt.Time)),
+	})
+}
+
+// csvString returns the value of s or an empty cell when it is missing
+func csvString(s *string) string {
+	if s == nil {
+		return ""
+	}
+
+	return *s
+}
+
+// csvTime formats ts as RFC 3339 or an empty cell when it is missing
+func csvTime(ts *buildkite.Timestamp) string {
+	if ts == nil {
+		return ""
+	}
+
+	return ts.Time.Format(time.RFC3339)
+}
+
+// csvSeconds formats d in seconds with millisecond precision
+func csvSeconds(d time.Duration) string {
+	return fmt.Sprintf("%.3f", d.Seconds())
+}
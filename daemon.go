@@ -2,28 +2,80 @@ package main
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"log"
+	"net/http"
+	"runtime/debug"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/buildkite/go-buildkite/v3/buildkite"
+	"go.opentelemetry.io/otel/attribute"
 	"go.opentelemetry.io/otel/trace"
 )
 
 // daemon contains all the info needed by the goroutines inside the long-lived process
 type daemon struct {
-	lastFinishedAt time.Time
-	tracer         trace.Tracer
-	buildKite      *buildkite.Client
-	pipelines      []string
-	wg             *sync.WaitGroup
-	cacheFilePath  string
-	sleepDuration  time.Duration
+	tracer        *tracerRouter
+	buildKite     *buildkite.Client
+	pipelines     []string
+	wg            *sync.WaitGroup
+	cacheFilePath string
+	sleepDuration time.Duration
+
+	// cut off point of each pipeline's next poll, pipelines advance independently
+	// so that one pipeline's newer builds do not hide another's.
+	// Pipelines not polled yet start from initialFinishedAt.
+	lastFinishedAtMu  sync.Mutex
+	lastFinishedAt    map[string]time.Time
+	initialFinishedAt time.Time
+
+	// when set, every poll lists the builds finished within this window instead of
+	// since the cut off point, see tailCmd
+	tailWindow time.Duration
+
+	// progress of a backfill, nil unless checkpoints are enabled
+	checkpoint *checkpoint
+
+	// bounds the pipelines polled in parallel, see PipelineConcurrency
+	pollLimit chan struct{}
+
+	// serializes writes of the cache shared by pipeline loops
+	cacheMu sync.Mutex
+
+	// builds being processed by each pipeline, waited for by its polls
+	buildsMu sync.Mutex
+	builds   map[string]*sync.WaitGroup
+
+	// export counters at the last check and the factor slowing polls down while
+	// exports fail, see backpressure
+	backpressureMu     sync.Mutex
+	spansExportedSeen  int64
+	spansFailedSeen    int64
+	backpressureFactor time.Duration
+
+	// pipelines of BuildKiteCluster, refreshed every BuildKiteClusterRefresh
+	clusterPipelines  []string
+	clusterResolvedAt time.Time
+
+	// builds being processed, keyed by "<pipeline>/<number>"
+	inFlight sync.Map
+
+	// bounds concurrent BuildKite API calls made by build goroutines
+	apiLimit chan struct{}
+
+	// pipeline details fetched lazily and shared by build goroutines, see lookupPipeline
+	pipelineMu      sync.Mutex
+	pipelineDetails map[string]*pipelineEntry
+	pipelineTeams   map[string]*pipelineEntry
 }
 
 // NewDaemon produce daemon struct that can be executed as a long-lived process
 func NewDaemon(
-	tracer trace.Tracer,
+	tracer *tracerRouter,
 	buildKite *buildkite.Client,
 	pipelines []string,
 	sleepDuration time.Duration,
@@ -31,50 +83,499 @@ func NewDaemon(
 ) *daemon {
 	wg := &sync.WaitGroup{}
 
-	// Default to HoneycombMaxRetention on initial run
-	// should be updated on subsequent runs
-	lastFinishedAt := time.Now().Add(-1 * HoneycombMaxRetention)
-
 	return &daemon{
-		lastFinishedAt: lastFinishedAt,
-		tracer:         tracer,
-		buildKite:      buildKite,
-		pipelines:      pipelines,
-		wg:             wg,
-		sleepDuration:  sleepDuration,
-		cacheFilePath:  cacheFilePath,
+		tracer:        tracer,
+		buildKite:     buildKite,
+		pipelines:     pipelines,
+		wg:            wg,
+		sleepDuration: sleepDuration,
+		cacheFilePath: cacheFilePath,
+
+		// Default to HoneycombMaxRetention on initial run
+		// should be updated on subsequent runs
+		lastFinishedAt:    make(map[string]time.Time, len(pipelines)),
+		initialFinishedAt: time.Now().Add(-1 * HoneycombMaxRetention),
+
+		apiLimit:        make(chan struct{}, BuildKiteMaxConcurrency),
+		pipelineDetails: make(map[string]*pipelineEntry),
+		pipelineTeams:   make(map[string]*pipelineEntry),
+		pollLimit:       make(chan struct{}, PipelineConcurrency),
+		builds:          make(map[string]*sync.WaitGroup),
+
+		backpressureFactor: 1,
 	}
 }
 
-// Exec execute the daemon as a long-lived process
-func (d *daemon) Exec(ctx context.Context) {
-	// TODO: implement graceful shutdown when SIGTERM/SIGKILL
+// Exec execute the daemon as a long-lived process until stop is closed, polling
+// each pipeline in its own loop, see pollLoop
+func (d *daemon) Exec(ctx context.Context, stop <-chan struct{}) {
+	// the cache is loaded once and shared by all pipeline loops, buildIDStore is safe for concurrent use
+	cache := NewCache(d.cacheFilePath)
+	defer cache.Close()
+
+	cachedBuildIDs := cache.loadCache()
+
+	// loops of the pipelines exported, each removed by closing its channel
+	var loops sync.WaitGroup
+	running := make(map[string]chan struct{})
 	for {
-		for _, pipeline := range d.pipelines {
-			d.wg.Add(1)
-			go d.processBuildKite(ctx, pipeline)
+		pipelines := d.pipelines
+		if BuildKiteCluster != "" {
+			pipelines = d.withClusterPipelines(pipelines)
+		}
+		for _, pipeline := range pipelines {
+			if _, ok := running[pipeline]; ok {
+				continue
+			}
+			removed := make(chan struct{})
+			running[pipeline] = removed
+			loops.Add(1)
+			go func(pipeline string) {
+				defer loops.Done()
+				d.pollLoop(ctx, stop, removed, pipeline, cache, cachedBuildIDs)
+			}(pipeline)
+		}
+		for pipeline, removed := range running {
+			if !contains(pipelines, pipeline) {
+				close(removed)
+				delete(running, pipeline)
+			}
 		}
-		d.wg.Wait()
 
-		log.Printf("sleeping for %s", d.sleepDuration)
-		time.Sleep(d.sleepDuration)
+		// only the pipelines of a cluster change while running
+		var refresh <-chan time.Time
+		if BuildKiteCluster != "" {
+			refresh = time.After(BuildKiteClusterRefresh)
+		}
+		select {
+		case <-stop:
+			log.Printf("shutting down")
+			loops.Wait()
+			return
+		case <-refresh:
+		}
+	}
+}
+
+// pollLoop polls the pipeline again one interval after each poll ended, until
+// stop or removed is closed
+func (d *daemon) pollLoop(ctx context.Context, stop, removed <-chan struct{}, pipeline string, cache *cache, cachedBuildIDs buildIDStore) {
+	for {
+		d.pollPipeline(ctx, stop, pipeline, cache, cachedBuildIDs)
+
+		wait := d.backpressure(d.pollInterval(pipeline))
+		log.Printf("pipeline %s: sleeping for %s", pipeline, wait)
+		select {
+		case <-stop:
+			return
+		case <-removed:
+			log.Printf("pipeline %s is no longer exported, stopping its polls", pipeline)
+			return
+		case <-time.After(wait):
+		}
 	}
 }
 
-// BuildKite pagination loop
-func (d *daemon) processBuildKite(ctx context.Context, pipeline string) {
+// poll exports the builds of all pipelines finished since the last poll once,
+// see pollPipeline
+func (d *daemon) poll(ctx context.Context, stop <-chan struct{}) {
 	cache := NewCache(d.cacheFilePath)
-	defer cache.fileStore.Close()
+	defer cache.Close()
 
 	cachedBuildIDs := cache.loadCache()
 
+	pipelines := d.pipelines
+	if BuildKiteCluster != "" {
+		pipelines = d.withClusterPipelines(pipelines)
+	}
+
+	var wg sync.WaitGroup
+	for _, pipeline := range pipelines {
+		wg.Add(1)
+		go func(pipeline string) {
+			defer wg.Done()
+			d.pollPipeline(ctx, stop, pipeline, cache, cachedBuildIDs)
+		}(pipeline)
+	}
+	wg.Wait()
+}
+
+// pollPipeline exports the builds of the pipeline finished since its last poll and
+// waits for them to be processed. Pipelines are polled in parallel, bounded by
+// PipelineConcurrency.
+//
+// When stop is closed, in-flight builds are drained for up to ShutdownDrainTimeout
+// instead of PollWaitTimeout.
+func (d *daemon) pollPipeline(ctx context.Context, stop <-chan struct{}, pipeline string, cache *cache, cachedBuildIDs buildIDStore) {
+	// a malformed API response must not crash the daemon, the pipeline is polled again next time
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("panic polling pipeline %s: %v\n%s", pipeline, r, debug.Stack())
+		}
+	}()
+
+	d.pollLimit <- struct{}{}
+	defer func() { <-d.pollLimit }()
+
+	// cancelled when the poll gives up waiting so that stuck workers are released
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// builds become children of the poll span through ctx. Build spans start in the past
+	// so they precede their parent, and builds routed to other datasets lose their parent.
+	var pollSpan trace.Span
+	if PollSpan {
+		ctx, pollSpan = d.tracer.Tracer("").Start(ctx, "poll", trace.WithSpanKind(trace.SpanKindInternal), trace.WithAttributes(attribute.String("pipeline", pipeline)))
+		// ended after waiting for the builds as defers run last
+		defer pollSpan.End()
+	}
+
+	// listing builds stops as soon as stop is closed, the builds already listed are drained below
+	listCtx, cancelList := context.WithCancel(ctx)
+	defer cancelList()
+	go func() {
+		select {
+		case <-stop:
+			cancelList()
+		case <-listCtx.Done():
+		}
+	}()
+
+	// spans are exported in the background, their retries count towards the poll they happen in
+	retryBefore := retryTime()
+
+	stats := d.processBuildKite(ctx, listCtx, pipeline, cachedBuildIDs)
+	if pollSpan != nil {
+		pollSpan.SetAttributes(
+			attribute.Int64("processed_builds", stats.processed),
+			attribute.Int64("skipped_builds", stats.skipped),
+			attribute.Int64("filtered_builds", stats.filtered),
+		)
+	}
+
+	// store all build IDs each run into cache, checkpoints only store exported builds
+	if d.checkpoint == nil {
+		d.cacheMu.Lock()
+		err := cache.writeCache(cachedBuildIDs)
+		d.cacheMu.Unlock()
+		if err != nil {
+			log.Fatalf("error writing cache: %v", err)
+		}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		d.buildsOf(pipeline).Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-stop:
+		log.Printf("pipeline %s: shutting down, draining builds in flight for up to %s", pipeline, ShutdownDrainTimeout)
+		select {
+		case <-done:
+		case <-time.After(ShutdownDrainTimeout):
+			log.Printf("pipeline %s: shutdown drain timed out after %s, abandoning builds still in flight: %v", pipeline, ShutdownDrainTimeout, d.inFlightBuilds(pipeline))
+		}
+	case <-time.After(PollWaitTimeout):
+		log.Printf("pipeline %s: poll did not finish within %s, proceeding with builds still in flight: %v", pipeline, PollWaitTimeout, d.inFlightBuilds(pipeline))
+	}
+
+	if spent := retryTime() - retryBefore; RetryBudgetPerPoll > 0 && spent > RetryBudgetPerPoll {
+		log.Printf("WARNING: poll of pipeline %s spent %s retrying, over the retry budget of %s, BuildKite or the OTLP endpoint may be degraded", pipeline, spent, RetryBudgetPerPoll)
+	}
+}
+
+// buildsOf returns the wait group of the builds of the pipeline being processed
+func (d *daemon) buildsOf(pipeline string) *sync.WaitGroup {
+	d.buildsMu.Lock()
+	defer d.buildsMu.Unlock()
+
+	wg, ok := d.builds[pipeline]
+	if !ok {
+		wg = &sync.WaitGroup{}
+		d.builds[pipeline] = wg
+	}
+
+	return wg
+}
+
+// inFlightBuilds returns the keys of the builds of the pipeline being processed
+func (d *daemon) inFlightBuilds(pipeline string) []string {
+	var inFlight []string
+	d.inFlight.Range(func(k, _ interface{}) bool {
+		if key := k.(string); strings.HasPrefix(key, pipeline+"/") {
+			inFlight = append(inFlight, key)
+		}
+		return true
+	})
+
+	return inFlight
+}
+
+// pollInterval returns the interval between polls of the pipeline
+func (d *daemon) pollInterval(pipeline string) time.Duration {
+	if interval, ok := PipelinePollIntervals[pipeline]; ok {
+		return interval
+	}
+
+	return d.sleepDuration
+}
+
+// backpressure slows polling down while exports fail, doubling the poll interval
+// after each poll whose export error rate reached BackpressureErrorRate, up to
+// BackpressureMaxInterval. The interval is reset once exports succeed again.
+func (d *daemon) backpressure(wait time.Duration) time.Duration {
+	d.backpressureMu.Lock()
+	defer d.backpressureMu.Unlock()
+
+	exported, failed := spansExported.Value(), spansFailed.Value()
+	newExported, newFailed := exported-d.spansExportedSeen, failed-d.spansFailedSeen
+	d.spansExportedSeen, d.spansFailedSeen = exported, failed
+
+	if BackpressureErrorRate <= 0 {
+		return wait
+	}
+
+	// without exports since the last check the export health is unknown, keep the factor
+	if total := newExported + newFailed; total > 0 {
+		rate := float64(newFailed) / float64(total)
+		if rate < BackpressureErrorRate {
+			if d.backpressureFactor > 1 {
+				log.Printf("export error rate %.2f recovered, resuming normal poll interval", rate)
+			}
+			d.backpressureFactor = 1
+		} else if d.sleepDuration*d.backpressureFactor < BackpressureMaxInterval {
+			d.backpressureFactor *= 2
+			log.Printf("export error rate %.2f, slowing polls down to every %s", rate, d.slowedInterval())
+		}
+	}
+
+	if slowed := d.slowedInterval(); d.backpressureFactor > 1 && slowed > wait {
+		return slowed
+	}
+
+	return wait
+}
+
+// slowedInterval returns the poll interval slowed down by backpressure
+func (d *daemon) slowedInterval() time.Duration {
+	slowed := d.sleepDuration * d.backpressureFactor
+	if slowed > BackpressureMaxInterval {
+		return BackpressureMaxInterval
+	}
+
+	return slowed
+}
+
+// finishedFrom returns the cut off point of the pipeline's next poll
+func (d *daemon) finishedFrom(pipeline string) time.Time {
+	// builds reported late are still within the window, the cache skips those already exported
+	if d.tailWindow > 0 {
+		return time.Now().Add(-d.tailWindow)
+	}
+
+	d.lastFinishedAtMu.Lock()
+	defer d.lastFinishedAtMu.Unlock()
+
+	if finishedAt, ok := d.lastFinishedAt[pipeline]; ok {
+		return finishedAt
+	}
+
+	return d.initialFinishedAt
+}
+
+// advanceFinishedFrom moves the cut off point of the pipeline forward to finishedAt
+func (d *daemon) advanceFinishedFrom(pipeline string, finishedAt time.Time) {
+	d.lastFinishedAtMu.Lock()
+	defer d.lastFinishedAtMu.Unlock()
+
+	if last, ok := d.lastFinishedAt[pipeline]; !ok || finishedAt.After(last) {
+		d.lastFinishedAt[pipeline] = finishedAt
+	}
+}
+
+// cutoffs returns a snapshot of the cut off point of each polled pipeline
+func (d *daemon) cutoffs() map[string]time.Time {
+	d.lastFinishedAtMu.Lock()
+	defer d.lastFinishedAtMu.Unlock()
+
+	cutoffs := make(map[string]time.Time, len(d.lastFinishedAt))
+	for pipeline, finishedAt := range d.lastFinishedAt {
+		cutoffs[pipeline] = finishedAt
+	}
+
+	return cutoffs
+}
+
+// checkpointCutoffs returns the cut off points a resumed backfill starts from without
+// skipping unexported builds. Builds processed concurrently are exported in any order,
+// so the cut off point of a pipeline only moves past its initial one with
+// OrderedProcessing, see processBuildKite.
+func (d *daemon) checkpointCutoffs() map[string]time.Time {
+	cutoffs := d.cutoffs()
+	for _, pipeline := range append(append([]string{}, d.pipelines...), d.clusterPipelines...) {
+		if _, ok := cutoffs[pipeline]; !ok {
+			cutoffs[pipeline] = d.initialFinishedAt
+		}
+	}
+
+	return cutoffs
+}
+
+// processInOrder processes builds one at a time from the earliest finished, only
+// advancing the cut off point past a build once it is exported so that it never
+// skips an unexported build. The cut off point is left as is unless advance is set,
+// when older builds could still be unlisted.
+//
+// Builds are only cached once processed, so that the builds left when listCtx is
+// cancelled are listed again by the next poll.
+func (d *daemon) processInOrder(ctx, listCtx context.Context, pipeline string, builds []buildkite.Build, cachedBuildIDs buildIDStore, advance bool) {
+	sort.SliceStable(builds, func(i, k int) bool {
+		return finishedTime(builds[i]).Before(finishedTime(builds[k]))
+	})
+
+	for i, b := range builds {
+		if listCtx.Err() != nil {
+			log.Printf("pipeline %s: poll cancelled, leaving %d builds for the next poll", pipeline, len(builds)-i)
+			return
+		}
+		// a build listed on two pages is processed once
+		if !cachedBuildIDs.Add(*b.ID) {
+			continue
+		}
+
+		d.wg.Add(1)
+		d.processBuild(ctx, b)
+		if advance && b.FinishedAt != nil {
+			d.advanceFinishedFrom(pipeline, b.FinishedAt.Time)
+		}
+	}
+}
+
+// finishedTime returns when a build finished, or the zero time when it has not
+func finishedTime(b buildkite.Build) time.Time {
+	if b.FinishedAt == nil {
+		return time.Time{}
+	}
+
+	return b.FinishedAt.Time
+}
+
+// pollStats counts what happened to the builds listed during a poll
+type pollStats struct {
+	processed, skipped, filtered int64
+}
+
+// processBuildKite polls one pipeline, retrying the whole poll with backoff when
+// listing builds fails. Builds are processed with ctx, listing and retries stop
+// once listCtx is cancelled.
+func (d *daemon) processBuildKite(ctx, listCtx context.Context, pipeline string, cachedBuildIDs buildIDStore) pollStats {
+	// self trace spans are kept off ctx so that build spans do not become their children
+	selfCtx, pollSpan := d.tracer.Internal().Start(listCtx, "poll", trace.WithAttributes(attribute.String("pipeline", pipeline)))
+	defer pollSpan.End()
+	// internal spans of the calls made for builds are children of the poll span instead
+	ctx = withSelfSpan(ctx, selfCtx)
+
+	var stats pollStats
+	var ordered *[]buildkite.Build
+	if OrderedProcessing {
+		ordered = &[]buildkite.Build{}
+	}
+	// retries list from the same cut off point, builds of the pages listed before a
+	// failure are cached so that they are skipped by the retry
+	finishedFrom := d.finishedFrom(pipeline)
+	var newest, truncatedAt time.Time
+	var listed bool
+	var retryStart time.Time
+	backoff := PollRetryBackoff
+	for attempt := 0; ; attempt++ {
+		finishedAt, truncated, complete, err := d.listBuilds(ctx, selfCtx, pipeline, finishedFrom, cachedBuildIDs, &stats, ordered)
+		if finishedAt.After(newest) {
+			newest = finishedAt
+		}
+		if attempt > 0 {
+			recordRetry("poll", 1, time.Since(retryStart))
+		}
+		if err == nil {
+			listed, truncatedAt = complete, truncated
+			break
+		}
+
+		pollSpan.RecordError(err)
+		if selfCtx.Err() != nil {
+			log.Printf("pipeline %s: poll cancelled, not retrying: %v", pipeline, err)
+			break
+		}
+		if isAuthError(err) {
+			log.Printf("pipeline %s: BuildKite API denied access, check that BUILDKITE_TOKEN is valid and has the read_builds scope, not retrying: %v", pipeline, err)
+			break
+		}
+		if attempt >= PollRetryAttempts {
+			log.Printf("pipeline %s: giving up poll after %d attempts: %v", pipeline, attempt+1, err)
+			break
+		}
+
+		log.Printf("pipeline %s: poll failed, retrying in %s: %v", pipeline, backoff, err)
+		retryStart = time.Now()
+		select {
+		case <-selfCtx.Done():
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+
+	// the cut off point only advances once all builds since it were listed, otherwise
+	// the builds of the pages which failed or were not listed would never be listed again
+	if ordered != nil {
+		d.processInOrder(ctx, selfCtx, pipeline, *ordered, cachedBuildIDs, listed)
+	} else if listed && !newest.IsZero() && d.checkpoint == nil {
+		// a checkpointed backfill could still be exporting older builds
+		d.advanceFinishedFrom(pipeline, newest)
+	}
+	// past the pages listed up to BuildKiteMaxPages, so that the pipeline does not
+	// list the same pages on every poll
+	if !truncatedAt.IsZero() {
+		d.advanceFinishedFrom(pipeline, truncatedAt)
+	}
+
+	pollSpan.SetAttributes(
+		attribute.Int64("processed_builds", stats.processed),
+		attribute.Int64("skipped_builds", stats.skipped),
+		attribute.Int64("filtered_builds", stats.filtered),
+	)
+	skippedBuilds.Add(pipeline, stats.skipped)
+	log.Printf("pipeline %s: processing %d builds, skipped %d cached builds, filtered out %d builds", pipeline, stats.processed, stats.skipped, stats.filtered)
+
+	return stats
+}
+
+// isAuthError reports whether err is an authentication or authorization error
+// from BuildKite API, which retrying cannot fix
+func isAuthError(err error) bool {
+	var resp *buildkite.ErrorResponse
+	if !errors.As(err, &resp) || resp.Response == nil {
+		return false
+	}
+
+	return resp.Response.StatusCode == http.StatusUnauthorized || resp.Response.StatusCode == http.StatusForbidden
+}
+
+// BuildKite pagination loop, returning the latest finish of the new builds listed
+// and whether all builds since finishedFrom were listed. When BuildKiteMaxPages
+// stops the listing, the earliest finish on the pages listed is also returned.
+//
+// New builds are processed concurrently as they are listed, or appended to ordered
+// when it is not nil
+func (d *daemon) listBuilds(ctx, selfCtx context.Context, pipeline string, finishedFrom time.Time, cachedBuildIDs buildIDStore, stats *pollStats, ordered *[]buildkite.Build) (time.Time, time.Time, bool, error) {
+	var newest, oldest time.Time
 	buildListOptions := &buildkite.BuildsListOptions{
 		// Only query from last run's cut off point to limit the number of
 		// requests needed on subsequent runs.
-		FinishedFrom: d.lastFinishedAt,
-		// Possible values are: running, scheduled, passed, failed, canceled, skipped and not_run.
-		// filters for only 'finished' states
-		State: []string{"passed", "failed", "canceled", "skipped"},
+		FinishedFrom: finishedFrom,
+		// filters for only 'finished' states by default, see BuildStates
+		State: BuildStates,
 		// Pagination options
 		ListOptions: buildkite.ListOptions{
 			Page:    1,
@@ -82,44 +583,76 @@ func (d *daemon) processBuildKite(ctx context.Context, pipeline string) {
 		},
 	}
 	for {
+		if err := selfCtx.Err(); err != nil {
+			return newest, time.Time{}, false, fmt.Errorf("stopped listing builds before page %d: %w", buildListOptions.Page, err)
+		}
+
 		log.Println("Calling API on page", buildListOptions.Page)
+		_, end := d.tracer.startCall(selfCtx, "ListByPipeline", BuildKiteRequestTimeout, attribute.Int("page", buildListOptions.Page))
 		builds, resp, err := d.buildKite.Builds.ListByPipeline(BuildKiteOrgName, pipeline, buildListOptions)
+		end(err, attribute.Int("builds", len(builds)))
 		if err != nil {
-			log.Printf("Issues calling BuildKite API: %v\n", err)
-			continue
+			return newest, time.Time{}, false, fmt.Errorf("error listing builds on page %d: %w", buildListOptions.Page, err)
 		}
 
 		for _, b := range builds {
-			if _, ok := cachedBuildIDs[*b.ID]; ok {
+			if b.FinishedAt != nil && (oldest.IsZero() || b.FinishedAt.Time.Before(oldest)) {
+				oldest = b.FinishedAt.Time
+			}
+			if b.ID == nil {
+				log.Printf("pipeline %s: ignoring build %s without ID", pipeline, buildName(b))
+				continue
+			}
+
+			if !shouldExport(b) {
+				// not added to cache so that builds could be exported once filters change
+				debugf("Filtering out build: %s", *b.ID)
+				stats.filtered++
+				continue
+			}
+
+			// add build ID to cache, keyed by UUID as build numbers collide across pipelines.
+			// Ordered builds are cached once processed, see processInOrder
+			if ordered != nil && cachedBuildIDs.Has(*b.ID) || ordered == nil && !cachedBuildIDs.Add(*b.ID) {
 				// build ID is in cache, skip processing
-				log.Println("Skipping build:", *b.ID)
+				debugf("Skipping build: %s", *b.ID)
+				stats.skipped++
 				continue
 			}
 
-			// add build ID to cache
-			cachedBuildIDs[*b.ID] = struct{}{}
+			stats.processed++
+			if ordered != nil {
+				*ordered = append(*ordered, b)
+				continue
+			}
 
-			if b.FinishedAt != nil && b.FinishedAt.After(d.lastFinishedAt) {
-				d.lastFinishedAt = b.FinishedAt.Time
+			if b.FinishedAt != nil && b.FinishedAt.Time.After(newest) {
+				newest = b.FinishedAt.Time
 			}
 
+			builds := d.buildsOf(pipeline)
+			builds.Add(1)
 			d.wg.Add(1)
-			go d.processBuild(ctx, b)
+			go func(b buildkite.Build) {
+				defer builds.Done()
+				d.processBuild(ctx, b)
+			}(b)
 		}
 
 		// use buildkite response header to determine next page
 		if resp.NextPage == 0 {
-			break
+			return newest, time.Time{}, true, nil
+		}
+		// builds are listed newest first, the older builds left unlisted keep the cut off point in place
+		if resp.NextPage <= buildListOptions.Page {
+			log.Printf("pipeline %s: next page %d does not advance from page %d, stopping pagination without advancing the cut off point", pipeline, resp.NextPage, buildListOptions.Page)
+			return newest, time.Time{}, false, nil
+		}
+		if BuildKiteMaxPages > 0 && buildListOptions.Page >= BuildKiteMaxPages {
+			log.Printf("WARNING: pipeline %s: reached max pages %d, advancing the cut off point to %s, the earliest finish listed. Builds finished before it and not listed are not exported", pipeline, BuildKiteMaxPages, oldest)
+			return newest, oldest, false, nil
 		}
 
 		buildListOptions.Page = resp.NextPage
 	}
-
-	// store all build IDs each run into cache
-	err := cache.writeCache(cachedBuildIDs)
-	if err != nil {
-		log.Fatalf("error writing cache: %v", err)
-	}
-
-	d.wg.Done()
 }
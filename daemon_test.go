@@ -0,0 +1,429 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/buildkite/go-buildkite/v3/buildkite"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// fakeBuildKite serves the builds of each pipeline, keyed by slug, on the BuildKite REST API
+// routes used by the daemon. Builds are listed on a single page regardless of finished_from.
+type fakeBuildKite struct {
+	mu     sync.Mutex
+	builds map[string][]buildkite.Build
+	// build detail jobs, keyed by "<pipeline>/<number>", fall back to the listed jobs
+	jobs map[string][]*buildkite.Job
+}
+
+func (f *fakeBuildKite) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	// /v2/organizations/<org>/pipelines/<pipeline>[/builds[/<number>]]
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/v2/organizations/"), "/")
+	if len(parts) < 3 || parts[1] != "pipelines" {
+		http.NotFound(w, r)
+		return
+	}
+	pipeline := parts[2]
+
+	var body interface{}
+	switch {
+	case len(parts) == 3:
+		body = buildkite.Pipeline{Slug: &pipeline}
+	case len(parts) == 4 && parts[3] == "builds":
+		body = f.builds[pipeline]
+	case len(parts) == 5 && parts[3] == "builds":
+		for _, b := range f.builds[pipeline] {
+			if b.Number == nil || strconv.Itoa(*b.Number) != parts[4] {
+				continue
+			}
+			if jobs, ok := f.jobs[pipeline+"/"+parts[4]]; ok {
+				b.Jobs = jobs
+			}
+			body = b
+		}
+	}
+	if body == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(body)
+}
+
+// newTestDaemon returns a daemon polling api and exporting spans to an in-memory
+// exporter, with its cache in a temporary directory
+func newTestDaemon(t *testing.T, api http.Handler, pipelines ...string) (*daemon, *tracetest.InMemoryExporter) {
+	t.Helper()
+
+	server := httptest.NewServer(api)
+	t.Cleanup(server.Close)
+
+	exporter := tracetest.NewInMemoryExporter()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	t.Cleanup(func() { provider.Shutdown(context.Background()) })
+
+	client := buildkite.NewClient(server.Client())
+	client.BaseURL, _ = url.Parse(server.URL + "/")
+
+	router := &tracerRouter{
+		defaultTracer:   provider.Tracer("test"),
+		pipelineTracers: map[string]trace.Tracer{},
+		internalTracer:  trace.NewNoopTracerProvider().Tracer(""),
+	}
+
+	return NewDaemon(router, client, pipelines, time.Minute, filepath.Join(t.TempDir(), "cache")), exporter
+}
+
+// pollOnce polls the pipeline like a run of the daemon and waits for the builds to be exported
+func pollOnce(t *testing.T, d *daemon, pipeline string) pollStats {
+	t.Helper()
+
+	cache := NewCache(d.cacheFilePath)
+	defer cache.Close()
+
+	ids := cache.loadCache()
+	stats := d.processBuildKite(context.Background(), context.Background(), pipeline, ids)
+	d.wg.Wait()
+	if err := cache.writeCache(ids); err != nil {
+		t.Fatalf("writeCache: %v", err)
+	}
+
+	return stats
+}
+
+// testBuild returns a passed build of pipeline which ran from start to finish
+func testBuild(pipeline, id string, number int, start, finish time.Time) buildkite.Build {
+	state := "passed"
+	return buildkite.Build{
+		ID:         &id,
+		Number:     &number,
+		State:      &state,
+		Pipeline:   &buildkite.Pipeline{Slug: &pipeline},
+		CreatedAt:  buildkite.NewTimestamp(start),
+		StartedAt:  buildkite.NewTimestamp(start),
+		FinishedAt: buildkite.NewTimestamp(finish),
+	}
+}
+
+func TestProcessBuildKiteSameNumberAcrossPipelines(t *testing.T) {
+	now := time.Now().UTC().Truncate(time.Second)
+	ids := []string{"0182c7d2-0000-4000-8000-000000000001", "0182c7d2-0000-4000-8000-000000000002"}
+	api := &fakeBuildKite{builds: map[string][]buildkite.Build{
+		"app": {testBuild("app", ids[0], 1, now.Add(-20*time.Minute), now.Add(-10*time.Minute))},
+		"web": {testBuild("web", ids[1], 1, now.Add(-20*time.Minute), now.Add(-10*time.Minute))},
+	}}
+	d, exporter := newTestDaemon(t, api, "app", "web")
+
+	for _, pipeline := range d.pipelines {
+		pollOnce(t, d, pipeline)
+	}
+
+	if n := len(exporter.GetSpans()); n != 2 {
+		t.Fatalf("exported %d spans, want one per pipeline", n)
+	}
+	if cached := loadTestCache(t, d.cacheFilePath); !reflect.DeepEqual(cached, ids) {
+		t.Fatalf("cached %q, want the build UUIDs %q", cached, ids)
+	}
+}
+
+func TestProcessBuildKiteSecondRunExportsNothing(t *testing.T) {
+	now := time.Now().UTC().Truncate(time.Second)
+	api := &fakeBuildKite{builds: map[string][]buildkite.Build{
+		"app": {
+			testBuild("app", "b2", 2, now.Add(-20*time.Minute), now.Add(-10*time.Minute)),
+			testBuild("app", "b1", 1, now.Add(-40*time.Minute), now.Add(-30*time.Minute)),
+		},
+	}}
+	d, exporter := newTestDaemon(t, api, "app")
+
+	pollOnce(t, d, "app")
+	if n := len(exporter.GetSpans()); n != 2 {
+		t.Fatalf("first run exported %d spans, want 2", n)
+	}
+	exporter.Reset()
+
+	// a new daemon starts from the initial cut off point, only the cache file is shared
+	second, _ := newTestDaemon(t, api, "app")
+	second.tracer = d.tracer
+	second.cacheFilePath = d.cacheFilePath
+
+	pollOnce(t, second, "app")
+	if spans := exporter.GetSpans(); len(spans) != 0 {
+		t.Fatalf("second run exported %d spans, want none", len(spans))
+	}
+}
+
+func TestProcessBuildKiteAdvancesCutoffToLatestFinish(t *testing.T) {
+	now := time.Now().UTC().Truncate(time.Second)
+	running := testBuild("app", "b4", 4, now.Add(-5*time.Minute), now)
+	running.FinishedAt = nil
+	api := &fakeBuildKite{builds: map[string][]buildkite.Build{
+		"app": {
+			running,
+			testBuild("app", "b3", 3, now.Add(-30*time.Minute), now.Add(-20*time.Minute)),
+			testBuild("app", "b2", 2, now.Add(-20*time.Minute), now.Add(-10*time.Minute)),
+			testBuild("app", "b1", 1, now.Add(-40*time.Minute), now.Add(-35*time.Minute)),
+		},
+	}}
+	d, _ := newTestDaemon(t, api, "app")
+
+	pollOnce(t, d, "app")
+
+	want := now.Add(-10 * time.Minute)
+	if got := d.finishedFrom("app"); !got.Equal(want) {
+		t.Fatalf("cut off point is %s, want the latest finish %s", got, want)
+	}
+}
+
+func TestAdvanceFinishedFrom(t *testing.T) {
+	d, _ := newTestDaemon(t, http.NotFoundHandler(), "app", "web")
+	initial := d.finishedFrom("web")
+	now := time.Now()
+
+	d.advanceFinishedFrom("app", now)
+	d.advanceFinishedFrom("app", now.Add(-time.Hour))
+	if got := d.finishedFrom("app"); !got.Equal(now) {
+		t.Fatalf("cut off point moved back to %s, want %s", got, now)
+	}
+
+	if got := d.finishedFrom("web"); !got.Equal(initial) {
+		t.Fatalf("cut off point of another pipeline moved to %s, want %s", got, initial)
+	}
+}
+
+// panicTracer panics on every span started, standing in for a bug hit by a malformed build
+type panicTracer struct {
+	trace.Tracer
+}
+
+func (panicTracer) Start(context.Context, string, ...trace.SpanStartOption) (context.Context, trace.Span) {
+	panic("malformed build")
+}
+
+func TestProcessBuildKiteRecoversPanickingBuild(t *testing.T) {
+	now := time.Now().UTC().Truncate(time.Second)
+	api := &fakeBuildKite{builds: map[string][]buildkite.Build{
+		"app": {testBuild("app", "b1", 1, now.Add(-20*time.Minute), now.Add(-10*time.Minute))},
+		"web": {testBuild("web", "b2", 2, now.Add(-20*time.Minute), now.Add(-10*time.Minute))},
+	}}
+	d, exporter := newTestDaemon(t, api, "app", "web")
+	d.tracer.pipelineTracers["app"] = panicTracer{}
+	deadBefore := deadLetters.Value()
+
+	for _, pipeline := range d.pipelines {
+		pollOnce(t, d, pipeline)
+	}
+
+	if n := deadLetters.Value() - deadBefore; n != 1 {
+		t.Fatalf("dead_letters increased by %d, want 1", n)
+	}
+	spanNamed(t, exporter, "2")
+}
+
+func TestProcessBuildKiteStopsListingWhenCancelled(t *testing.T) {
+	now := time.Now().UTC().Truncate(time.Second)
+	api := &fakeBuildKite{builds: map[string][]buildkite.Build{
+		"app": {testBuild("app", "b1", 1, now.Add(-20*time.Minute), now.Add(-10*time.Minute))},
+	}}
+	d, exporter := newTestDaemon(t, api, "app")
+
+	attempts, backoff := PollRetryAttempts, PollRetryBackoff
+	PollRetryAttempts, PollRetryBackoff = 5, time.Hour
+	t.Cleanup(func() { PollRetryAttempts, PollRetryBackoff = attempts, backoff })
+
+	listCtx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	cache := NewCache(d.cacheFilePath)
+	defer cache.Close()
+
+	done := make(chan pollStats)
+	go func() { done <- d.processBuildKite(context.Background(), listCtx, "app", cache.loadCache()) }()
+
+	select {
+	case stats := <-done:
+		if stats.processed != 0 {
+			t.Fatalf("processed %d builds after cancellation, want none", stats.processed)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("poll kept retrying after cancellation")
+	}
+	d.wg.Wait()
+	if n := len(exporter.GetSpans()); n != 0 {
+		t.Fatalf("exported %d spans after cancellation, want none", n)
+	}
+	if got := d.finishedFrom("app"); !got.Equal(d.initialFinishedAt) {
+		t.Fatalf("cut off point moved to %s after cancellation", got)
+	}
+}
+
+func TestProcessInOrderStopsWhenCancelled(t *testing.T) {
+	now := time.Now().UTC().Truncate(time.Second)
+	builds := []buildkite.Build{
+		testBuild("app", "b2", 2, now.Add(-20*time.Minute), now.Add(-10*time.Minute)),
+		testBuild("app", "b1", 1, now.Add(-40*time.Minute), now.Add(-30*time.Minute)),
+	}
+	d, exporter := newTestDaemon(t, http.NotFoundHandler(), "app")
+	ids := newBuildIDSet()
+
+	listCtx, cancel := context.WithCancel(context.Background())
+	cancel()
+	d.processInOrder(context.Background(), listCtx, "app", builds, ids, true)
+	d.wg.Wait()
+
+	if n := len(exporter.GetSpans()); n != 0 {
+		t.Fatalf("exported %d spans after cancellation, want none", n)
+	}
+	if ids.Len() != 0 {
+		t.Fatalf("cached %q, want the unprocessed builds left for the next poll", ids.IDs())
+	}
+
+	d.processInOrder(context.Background(), context.Background(), "app", builds, ids, true)
+	d.wg.Wait()
+
+	if n := len(exporter.GetSpans()); n != 2 {
+		t.Fatalf("exported %d spans, want 2", n)
+	}
+	if got, want := d.finishedFrom("app"), now.Add(-10*time.Minute); !got.Equal(want) {
+		t.Fatalf("cut off point is %s, want %s", got, want)
+	}
+}
+
+func TestExecPollsPipelinesOnTheirOwnIntervals(t *testing.T) {
+	api := &fakeBuildKite{builds: map[string][]buildkite.Build{}}
+	var mu sync.Mutex
+	lists := map[string]int{}
+	counting := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if parts := strings.Split(r.URL.Path, "/"); len(parts) == 7 && parts[6] == "builds" {
+			mu.Lock()
+			lists[parts[5]]++
+			mu.Unlock()
+		}
+		api.ServeHTTP(w, r)
+	})
+	d, _ := newTestDaemon(t, counting, "fast", "slow")
+	d.sleepDuration = time.Hour
+
+	intervals := PipelinePollIntervals
+	PipelinePollIntervals = map[string]time.Duration{"fast": 10 * time.Millisecond}
+	t.Cleanup(func() { PipelinePollIntervals = intervals })
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		d.Exec(context.Background(), stop)
+		close(done)
+	}()
+
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		mu.Lock()
+		fast := lists["fast"]
+		mu.Unlock()
+		if fast >= 3 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("fast pipeline listed %d times, want at least 3", fast)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	close(stop)
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Exec did not return after stop")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if lists["slow"] != 1 {
+		t.Fatalf("slow pipeline listed %d times, want once", lists["slow"])
+	}
+}
+
+func TestProcessBuildKiteTracesCallsUnderPollSpan(t *testing.T) {
+	fetch := BuildKiteFetchBuildDetail
+	BuildKiteFetchBuildDetail = true
+	t.Cleanup(func() { BuildKiteFetchBuildDetail = fetch })
+
+	now := time.Now().UTC().Truncate(time.Second)
+	api := &fakeBuildKite{builds: map[string][]buildkite.Build{
+		"app": {testBuild("app", "b1", 1, now.Add(-20*time.Minute), now.Add(-10*time.Minute))},
+	}}
+	d, exporter := newTestDaemon(t, api, "app")
+
+	internal := tracetest.NewInMemoryExporter()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(internal))
+	t.Cleanup(func() { provider.Shutdown(context.Background()) })
+	d.tracer.internalTracer = provider.Tracer("internal")
+
+	pollOnce(t, d, "app")
+
+	poll := spanNamed(t, internal, "poll")
+	for _, name := range []string{"ListByPipeline", "GetBuild", "GetPipeline"} {
+		span := spanNamed(t, internal, name)
+		if span.Parent.SpanID() != poll.SpanContext.SpanID() {
+			t.Errorf("span %s is not a child of the poll span", name)
+		}
+		if _, ok := spanAttribute(span, "elapsed_ms"); !ok {
+			t.Errorf("span %s has no elapsed_ms attribute", name)
+		}
+	}
+	if build := spanNamed(t, exporter, "1"); build.Parent.IsValid() {
+		t.Errorf("build span has parent %s, want a root span", build.Parent.SpanID())
+	}
+}
+
+func TestProcessBuildKiteAdvancesCutoffAtMaxPages(t *testing.T) {
+	now := time.Now().UTC().Truncate(time.Second)
+	var builds []buildkite.Build
+	for i := 0; i < 6; i++ {
+		finish := now.Add(-time.Duration(i+1) * 10 * time.Minute)
+		builds = append(builds, testBuild("app", fmt.Sprintf("b%d", 6-i), 6-i, finish.Add(-5*time.Minute), finish))
+	}
+	// two builds per page, newest first, linking to the next page
+	api := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+		if page < 1 {
+			page = 1
+		}
+		if page < 3 {
+			w.Header().Set("Link", fmt.Sprintf(`<%s?page=%d>; rel="next"`, r.URL.Path, page+1))
+		}
+		json.NewEncoder(w).Encode(builds[(page-1)*2 : page*2])
+	})
+	d, exporter := newTestDaemon(t, api, "app")
+
+	pages := BuildKiteMaxPages
+	BuildKiteMaxPages = 2
+	t.Cleanup(func() { BuildKiteMaxPages = pages })
+
+	pollOnce(t, d, "app")
+
+	if n := len(exporter.GetSpans()); n != 4 {
+		t.Fatalf("exported %d spans, want the builds of 2 pages", n)
+	}
+	if got, want := d.finishedFrom("app"), builds[3].FinishedAt.Time; !got.Equal(want) {
+		t.Fatalf("cut off point is %s, want the earliest finish listed %s", got, want)
+	}
+}
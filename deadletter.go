@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/buildkite/go-buildkite/v3/buildkite"
+)
+
+// deadLetters counts builds which failed to process, see recordDeadLetter
+var deadLetters = expvar.NewInt("dead_letters")
+
+// deadLetterMu serializes appends of build goroutines to DeadLetterFile
+var deadLetterMu sync.Mutex
+
+// deadLetter is a build which failed to process, written to DeadLetterFile as one
+// JSON object per line so that it can be exported again with the build command
+type deadLetter struct {
+	Time     time.Time `json:"time"`
+	BuildID  string    `json:"build_id"`
+	Pipeline string    `json:"pipeline"`
+	Number   string    `json:"number"`
+	Error    string    `json:"error"`
+}
+
+// recordDeadLetter logs the build which failed to process and appends it to
+// DeadLetterFile when set
+func recordDeadLetter(b buildkite.Build, err error) {
+	deadLetters.Add(1)
+
+	letter := deadLetter{
+		Time:   time.Now(),
+		Number: buildName(b),
+		Error:  err.Error(),
+	}
+	if b.ID != nil {
+		letter.BuildID = *b.ID
+	}
+	if b.Pipeline != nil && b.Pipeline.Slug != nil {
+		letter.Pipeline = *b.Pipeline.Slug
+	}
+	log.Printf("failed to process build %s/%s: %v", letter.Pipeline, letter.Number, err)
+
+	if DeadLetterFile == "" {
+		return
+	}
+
+	line, err := json.Marshal(letter)
+	if err != nil {
+		log.Printf("error encoding dead letter: %v", err)
+		return
+	}
+
+	deadLetterMu.Lock()
+	defer deadLetterMu.Unlock()
+
+	f, err := os.OpenFile(DeadLetterFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		log.Printf("could not open dead letter file: %v", err)
+		return
+	}
+	defer f.Close()
+
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		log.Printf("error writing dead letter: %v", err)
+	}
+}
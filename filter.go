@@ -0,0 +1,93 @@
+package main
+
+import (
+	"path"
+
+	"github.com/buildkite/go-buildkite/v3/buildkite"
+)
+
+// shouldExport reports whether a build passes the configured build filters
+func shouldExport(b buildkite.Build) bool {
+	if len(BuildSourceFilter) > 0 {
+		if b.Source == nil || !contains(BuildSourceFilter, *b.Source) {
+			return false
+		}
+	}
+
+	if len(BranchInclude) > 0 || len(BranchExclude) > 0 {
+		if b.Branch == nil {
+			return len(BranchInclude) == 0
+		}
+		if len(BranchInclude) > 0 && !matchesAny(BranchInclude, *b.Branch) {
+			return false
+		}
+		if matchesAny(BranchExclude, *b.Branch) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// isUnhealthy reports whether a build failed, was canceled or has a failed or retried job
+func isUnhealthy(b buildkite.Build) bool {
+	if b.State != nil && (*b.State == "failed" || *b.State == "canceled") {
+		return true
+	}
+
+	for _, j := range b.Jobs {
+		if j.Retried || (j.State != nil && *j.State == "failed") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// isExcludedJob reports whether the name, label or step key of a job matches JobNameExclude
+func isExcludedJob(j *buildkite.Job) bool {
+	if len(JobNameExclude) == 0 {
+		return false
+	}
+
+	for _, name := range []*string{j.Name, j.Label, j.StepKey} {
+		if name != nil && matchesAny(JobNameExclude, *name) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// matchesAny reports whether s matches any of the glob patterns
+func matchesAny(patterns []string, s string) bool {
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, s); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// contains reports whether s is in list
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+
+	return false
+}
+
+// containsInt reports whether i is in list
+func containsInt(list []int, i int) bool {
+	for _, v := range list {
+		if v == i {
+			return true
+		}
+	}
+
+	return false
+}
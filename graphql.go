@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// jobTimelineQuery fetches the event timeline of every command job in a build.
+//
+// reference: https://buildkite.com/docs/apis/graphql-api
+const jobTimelineQuery = `query ($slug: ID!) {
+  build(slug: $slug) {
+    jobs(first: 500) {
+      count
+      edges {
+        node {
+          ... on JobTypeCommand {
+            uuid
+            concurrency {
+              group
+              limit
+            }
+            events(first: 100) {
+              edges {
+                node {
+                  type
+                  timestamp
+                }
+              }
+            }
+          }
+        }
+      }
+    }
+  }
+}`
+
+// jobEvent is a single state transition of a job as reported by BuildKite GraphQL API
+type jobEvent struct {
+	Type      string    `json:"type"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// jobConcurrency is the concurrency group limiting a job
+type jobConcurrency struct {
+	Group string `json:"group"`
+	Limit int    `json:"limit"`
+}
+
+// jobTimeline is what GraphQL API tells about a job beyond REST API
+type jobTimeline struct {
+	Events      []jobEvent
+	Concurrency *jobConcurrency
+}
+
+type jobTimelineResponse struct {
+	Build struct {
+		Jobs struct {
+			Count int `json:"count"`
+			Edges []struct {
+				Node struct {
+					UUID        string          `json:"uuid"`
+					Concurrency *jobConcurrency `json:"concurrency"`
+					Events      struct {
+						Edges []struct {
+							Node jobEvent `json:"node"`
+						} `json:"edges"`
+					} `json:"events"`
+				} `json:"node"`
+			} `json:"edges"`
+		} `json:"jobs"`
+	} `json:"build"`
+}
+
+// pipelineTeamsQuery fetches the first team a pipeline belongs to, which is taken as
+// its owner. Teams past the first are not fetched as they are never used.
+const pipelineTeamsQuery = `query ($slug: ID!) {
+  pipeline(slug: $slug) {
+    teams(first: 1) {
+      edges {
+        node {
+          team {
+            slug
+          }
+        }
+      }
+    }
+  }
+}`
+
+type pipelineTeamsResponse struct {
+	Pipeline struct {
+		Teams struct {
+			Edges []struct {
+				Node struct {
+					Team struct {
+						Slug string `json:"slug"`
+					} `json:"team"`
+				} `json:"node"`
+			} `json:"edges"`
+		} `json:"teams"`
+	} `json:"pipeline"`
+}
+
+// graphqlResponse is the envelope of every GraphQL API response
+type graphqlResponse struct {
+	Data   json.RawMessage `json:"data"`
+	Errors []struct {
+		Message string `json:"message"`
+	} `json:"errors"`
+}
+
+// apiClient calls GraphQL and Test Analytics APIs within BuildKiteRequestTimeout
+var apiClient = &http.Client{Timeout: BuildKiteRequestTimeout}
+
+// queryGraphQL runs a GraphQL query and decodes its data into result
+func queryGraphQL(ctx context.Context, query string, variables map[string]string, result interface{}) error {
+	body, err := json.Marshal(map[string]interface{}{
+		"query":     query,
+		"variables": variables,
+	})
+	if err != nil {
+		return fmt.Errorf("error encoding graphql query: %v", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, BuildKiteGraphQLEndPoint, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("error creating graphql request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+BuildKiteApiToken)
+	req.Header.Set("User-Agent", BuildKiteUserAgent)
+
+	resp, err := apiClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("error calling graphql api: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected graphql status: %s", resp.Status)
+	}
+
+	var envelope graphqlResponse
+	if err := json.NewDecoder(resp.Body).Decode(&envelope); err != nil {
+		return fmt.Errorf("error decoding graphql response: %v", err)
+	}
+	if len(envelope.Errors) > 0 {
+		return fmt.Errorf("graphql error: %s", envelope.Errors[0].Message)
+	}
+	if err := json.Unmarshal(envelope.Data, result); err != nil {
+		return fmt.Errorf("error decoding graphql data: %v", err)
+	}
+
+	return nil
+}
+
+// fetchJobTimelines returns the job events and concurrency groups of a build keyed by job UUID,
+// along with the total number of jobs in the build
+func fetchJobTimelines(ctx context.Context, pipeline string, buildNumber int) (map[string]jobTimeline, int, error) {
+	var result jobTimelineResponse
+	err := queryGraphQL(ctx, jobTimelineQuery, map[string]string{
+		"slug": fmt.Sprintf("%s/%s/%d", BuildKiteOrgName, pipeline, buildNumber),
+	}, &result)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	timelines := make(map[string]jobTimeline)
+	for _, j := range result.Build.Jobs.Edges {
+		// non-command jobs (wait, block, trigger) are not selected and have no uuid
+		if j.Node.UUID == "" {
+			continue
+		}
+		timeline := jobTimeline{Concurrency: j.Node.Concurrency}
+		for _, e := range j.Node.Events.Edges {
+			timeline.Events = append(timeline.Events, e.Node)
+		}
+		timelines[j.Node.UUID] = timeline
+	}
+
+	return timelines, result.Build.Jobs.Count, nil
+}
+
+// fetchPipelineTeams returns the slug of the first team a pipeline belongs to, see pipelineTeamsQuery
+func fetchPipelineTeams(ctx context.Context, pipeline string) ([]string, error) {
+	var result pipelineTeamsResponse
+	err := queryGraphQL(ctx, pipelineTeamsQuery, map[string]string{
+		"slug": fmt.Sprintf("%s/%s", BuildKiteOrgName, pipeline),
+	}, &result)
+	if err != nil {
+		return nil, err
+	}
+
+	var teams []string
+	for _, t := range result.Pipeline.Teams.Edges {
+		teams = append(teams, t.Node.Team.Slug)
+	}
+
+	return teams, nil
+}
@@ -2,7 +2,12 @@ package main
 
 import (
 	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/buildkite/go-buildkite/v3/buildkite"
 	"go.opentelemetry.io/otel/attribute"
@@ -10,12 +15,41 @@ import (
 	"go.opentelemetry.io/otel/trace"
 )
 
-func (d *daemon) processJob(ctx context.Context, buildNumber string, j *buildkite.Job) {
+func (d *daemon) processJob(ctx context.Context, tracer trace.Tracer, b buildkite.Build, j *buildkite.Job, timeline jobTimeline, tests *testCounts, flaky bool) {
 	if j.StartedAt == nil || j.FinishedAt == nil {
 		return
 	}
 
-	_, jSpan := d.tracer.Start(ctx, *j.Name, trace.WithTimestamp(j.StartedAt.Time))
+	// excluded jobs still count towards build level aggregates as those use b.Jobs
+	if j.Type != nil && contains(JobTypeExclude, *j.Type) || isExcludedJob(j) {
+		return
+	}
+
+	opts := []trace.SpanStartOption{trace.WithTimestamp(j.StartedAt.Time), trace.WithSpanKind(JobSpanKind)}
+
+	// In job mode every job is the root of its own trace, linked to its build span.
+	// Per-job dashboards and sampling become possible, but the build waterfall is lost
+	// and build attributes are duplicated on every job, increasing event size.
+	jobRoot := TraceMode == "job"
+	if jobRoot {
+		opts = append(opts, trace.WithNewRoot(), trace.WithLinks(trace.LinkFromContext(ctx)))
+	}
+
+	_, jSpan := tracer.Start(ctx, jobName(j), opts...)
+	attrs := newAttributeLimiter(jSpan)
+
+	// build info which would otherwise be found on the parent span
+	if jobRoot {
+		attrs.SetAttributes(attribute.String("org", BuildKiteOrgName))
+		attrs.SetAttributes(attribute.String("build_number", buildName(b)))
+		if b.Pipeline != nil {
+			attrs.SetString("pipeline", b.Pipeline.Slug)
+		}
+		attrs.SetString("build_state", b.State)
+		attrs.SetString("build_url", b.WebURL)
+		attrs.SetString("branch", b.Branch)
+		attrs.SetString("commit", b.Commit)
+	}
 
 	// job timing:
 	//   scheduled
@@ -26,21 +60,26 @@ func (d *daemon) processJob(ctx context.Context, buildNumber string, j *buildkit
 	//
 	// reference: https://buildkite.com/docs/apis/rest-api/builds#timestamp-attributes
 	if j.ScheduledAt != nil && j.CreatedAt != nil {
-		jSpan.SetAttributes(attribute.Int64("schedule_duration_ms", j.CreatedAt.Time.Sub(j.ScheduledAt.Time).Microseconds()))
+		attrs.SetAttributes(attribute.Int64("schedule_duration_ms", j.CreatedAt.Time.Sub(j.ScheduledAt.Time).Microseconds()))
 	}
 	if j.CreatedAt != nil && j.RunnableAt != nil {
-		jSpan.SetAttributes(attribute.Int64("create_duration_ms", j.RunnableAt.Time.Sub(j.CreatedAt.Time).Microseconds()))
+		attrs.SetAttributes(attribute.Int64("create_duration_ms", j.RunnableAt.Time.Sub(j.CreatedAt.Time).Microseconds()))
 	}
 	if j.RunnableAt != nil {
-		jSpan.SetAttributes(attribute.Int64("runnable_duration_ms", j.StartedAt.Time.Sub(j.RunnableAt.Time).Microseconds()))
+		attrs.SetAttributes(attribute.Int64("runnable_duration_ms", j.StartedAt.Time.Sub(j.RunnableAt.Time).Microseconds()))
+	}
+
+	// build level queue time, to compare queuing of jobs against their build
+	if queue, ok := buildQueueDuration(b); ok {
+		attrs.SetAttributes(attribute.Float64("build_queue_seconds", queue.Seconds()))
 	}
 
 	// agent state
 	if j.State != nil {
-		jSpan.SetAttributes(attribute.String("state", *j.State))
+		attrs.SetAttributes(attribute.String("state", *j.State))
 		switch *j.State {
 		case "failed":
-			jSpan.SetStatus(codes.Error, *j.State)
+			jSpan.SetStatus(codes.Error, "failed: "+jobFailureDescription(j))
 		case "passed", "finished":
 			jSpan.SetStatus(codes.Ok, *j.State)
 		default:
@@ -49,41 +88,277 @@ func (d *daemon) processJob(ctx context.Context, buildNumber string, j *buildkit
 	}
 
 	// job metadata
-	jSpan.SetAttributes(attribute.Int("retry_count", j.RetriesCount))
-	jSpan.SetAttributes(attribute.Bool("retried", j.Retried))
-	jSpan.SetAttributes(attribute.Bool("soft_failed", j.SoftFailed))
-	if j.LogsURL != nil {
-		jSpan.SetAttributes(attribute.String("url", *j.LogsURL))
+	attrs.SetAttributes(attribute.Int("retry_count", j.RetriesCount))
+	attrs.SetAttributes(attribute.Bool("retried", j.Retried))
+	if flaky {
+		attrs.SetAttributes(attribute.Bool("flaky", true))
 	}
-	if j.StepKey != nil {
-		jSpan.SetAttributes(attribute.String("step_key", *j.StepKey))
+	if RetryEvents {
+		for i, prev := range previousAttempts(b.Jobs, j) {
+			eventAttrs := []attribute.KeyValue{attribute.Int("attempt", i+1)}
+			if prev.ID != nil {
+				eventAttrs = append(eventAttrs, attribute.String("job_id", *prev.ID))
+			}
+			if prev.State != nil {
+				eventAttrs = append(eventAttrs, attribute.String("state", *prev.State))
+			}
+			if prev.ExitStatus != nil {
+				eventAttrs = append(eventAttrs, attribute.Int("exit_status", *prev.ExitStatus))
+			}
+			eventOpts := []trace.EventOption{trace.WithAttributes(eventAttrs...)}
+			if ts := firstTimestamp(prev.FinishedAt, prev.StartedAt, prev.CreatedAt); ts != nil {
+				eventOpts = append(eventOpts, trace.WithTimestamp(ts.Time))
+			}
+			jSpan.AddEvent("retry", eventOpts...)
+		}
 	}
-	if j.ExitStatus != nil {
-		jSpan.SetAttributes(attribute.Int("exit_status", *j.ExitStatus))
+	attrs.SetAttributes(attribute.Bool("soft_failed", j.SoftFailed))
+	attrs.SetString("url", j.LogsURL)
+	attrs.SetString("step_key", j.StepKey)
+	attrs.SetInt("exit_status", j.ExitStatus)
+
+	// compare the soft_failed flag of failed jobs against the soft_fail rules configured
+	// on the exporter, prefixed as they are not read from BuildKite
+	if len(SoftFailExitStatuses) > 0 && j.ExitStatus != nil && *j.ExitStatus != 0 {
+		attrs.SetAttributes(
+			attribute.IntSlice("exporter_soft_fail_exit_statuses", SoftFailExitStatuses),
+			attribute.Bool("exporter_soft_fail_allowed", containsInt(SoftFailExitStatuses, *j.ExitStatus)),
+		)
 	}
 
 	// agent data
-	if j.Agent.Name != nil {
-		jSpan.SetAttributes(attribute.String("agent_name", *j.Agent.Name))
+	attrs.SetString("agent_name", j.Agent.Name)
+	attrs.SetString("agent_hostname", j.Agent.Hostname)
+	attrs.SetString("agent_ip", j.Agent.IPAddress)
+	attrs.SetString("agent_version", j.Agent.Version)
+	// TODO: allow filtering metadata keys
+	// Assuming that agent metadata are kv pairs separated by AgentMetadataSeparator
+	attrs.SetKeyValues("agent_", AgentMetadataSeparator, j.Agent.Metadata)
+
+	// typed attributes promoted from agent metadata, e.g. spot=true
+	for attr, key := range AgentMetadataBools {
+		if v, ok := agentMetadataValue(j.Agent.Metadata, key); ok {
+			if b, err := strconv.ParseBool(v); err == nil {
+				attrs.SetAttributes(attribute.Bool(attr, b))
+			} else {
+				debugf("agent metadata %s of job %s is not a boolean: %q", key, jobName(j), v)
+			}
+		}
 	}
-	if j.Agent.Hostname != nil {
-		jSpan.SetAttributes(attribute.String("agent_hostname", *j.Agent.Hostname))
+
+	// tests run by the job from Test Analytics
+	if tests != nil {
+		attrs.SetAttributes(
+			attribute.Int("tests_passed", tests.Passed),
+			attribute.Int("tests_failed", tests.Failed),
+			attribute.Int("tests_flaky", tests.Flaky),
+		)
 	}
-	if j.Agent.IPAddress != nil {
-		jSpan.SetAttributes(attribute.String("agent_ip", *j.Agent.IPAddress))
+
+	// concurrency group from GraphQL API
+	if c := timeline.Concurrency; c != nil {
+		attrs.SetAttributes(
+			attribute.String("concurrency_group", c.Group),
+			attribute.Int("concurrency_limit", c.Limit),
+		)
+		if wait, ok := concurrencyGatedWait(j, c); ok {
+			attrs.SetAttributes(
+				attribute.String("wait_reason", "concurrency_group"),
+				attribute.Float64("concurrency_gated_seconds", wait.Seconds()),
+			)
+		}
 	}
-	if j.Agent.Version != nil {
-		jSpan.SetAttributes(attribute.String("agent_version", *j.Agent.Version))
+
+	// job timeline from GraphQL API, falling back to REST timestamps
+	events := timeline.Events
+	if len(events) == 0 {
+		events = jobLifecycleEvents(j)
 	}
-	// TODO: allow filtering metadata keys
-	for _, m := range j.Agent.Metadata {
-		// Assuming that agent metadata are kv pairs separated by '='
-		token := strings.Split(m, "=")
-		if len(token) != 2 {
+	for _, e := range events {
+		jSpan.AddEvent(strings.ToLower(e.Type), trace.WithTimestamp(e.Timestamp))
+	}
+
+	finishedAt, skewed := clampEndTime(j.StartedAt.Time, j.FinishedAt.Time)
+	if skewed {
+		log.Printf("job %s finished at %s before it started at %s, clamping to zero duration", jobName(j), j.FinishedAt, j.StartedAt)
+		jSpan.SetAttributes(attribute.Bool("clock_skew", true))
+	}
+
+	pipeline, state := "", ""
+	if b.Pipeline != nil && b.Pipeline.Slug != nil {
+		pipeline = *b.Pipeline.Slug
+	}
+	if j.State != nil {
+		state = *j.State
+	}
+	recordDuration(ctx, jobDurations, finishedAt.Sub(j.StartedAt.Time),
+		attribute.String("pipeline", pipeline),
+		attribute.String("state", state),
+	)
+	csvExport.WriteJob(pipeline, b, j, finishedAt)
+
+	jSpan.End(trace.WithTimestamp(finishedAt))
+}
+
+// jobName returns the job name, falling back to its label or type for jobs
+// without a name such as wait steps
+func jobName(j *buildkite.Job) string {
+	for _, name := range []*string{j.Name, j.Label, j.Type} {
+		if name != nil && *name != "" {
+			return *name
+		}
+	}
+
+	return "unknown"
+}
+
+// concurrencyGatedWait returns how long a job of a concurrency group waited from being
+// scheduled until it became runnable. BuildKite does not report why a job was held, so
+// for jobs of a concurrency group this wait is attributed to the group.
+func concurrencyGatedWait(j *buildkite.Job, c *jobConcurrency) (time.Duration, bool) {
+	if c == nil || j.ScheduledAt == nil || j.RunnableAt == nil || j.RunnableAt.Time.Before(j.ScheduledAt.Time) {
+		return 0, false
+	}
+
+	return j.RunnableAt.Time.Sub(j.ScheduledAt.Time), true
+}
+
+// agentMetadataValue returns the value of key in the agent metadata,
+// split like SetKeyValues on the first AgentMetadataSeparator
+func agentMetadataValue(metadata []string, key string) (string, bool) {
+	for _, kv := range metadata {
+		token := strings.SplitN(kv, AgentMetadataSeparator, 2)
+		if len(token) == 2 && token[0] == key {
+			return token[1], true
+		}
+	}
+
+	return "", false
+}
+
+// jobFailureDescription describes a failed job, e.g. `"tests" exit 1`
+func jobFailureDescription(j *buildkite.Job) string {
+	if j.ExitStatus == nil {
+		return fmt.Sprintf("%q", jobName(j))
+	}
+
+	return fmt.Sprintf("%q exit %d", jobName(j), *j.ExitStatus)
+}
+
+// jobLifecycleEvents builds the job timeline from the timestamps available in REST API.
+//
+//	dispatched: job became runnable and could be dispatched to an agent
+//	accepted:   job was accepted by an agent and started running
+//
+// Missing timestamps are skipped and events are sorted by time as agent clocks
+// could report them out of order.
+func jobLifecycleEvents(j *buildkite.Job) []jobEvent {
+	var events []jobEvent
+	for _, e := range []struct {
+		name string
+		ts   *buildkite.Timestamp
+	}{
+		{"scheduled", j.ScheduledAt},
+		{"created", j.CreatedAt},
+		{"dispatched", j.RunnableAt},
+		{"accepted", j.StartedAt},
+		{"finished", j.FinishedAt},
+	} {
+		if e.ts == nil || e.ts.Time.IsZero() {
 			continue
 		}
-		jSpan.SetAttributes(attribute.String("agent_"+token[0], token[1]))
+		events = append(events, jobEvent{Type: e.name, Timestamp: e.ts.Time})
+	}
+
+	sort.SliceStable(events, func(i, k int) bool {
+		return events[i].Timestamp.Before(events[k].Timestamp)
+	})
+
+	return events
+}
+
+// flakySteps returns the step keys with a failed attempt followed by a passed
+// attempt, i.e. steps which passed on retry
+func flakySteps(jobs []*buildkite.Job) map[string]bool {
+	firstFailed := make(map[string]int)
+	lastPassed := make(map[string]int)
+	for _, j := range jobs {
+		if j.StepKey == nil || j.State == nil {
+			continue
+		}
+		switch *j.State {
+		case "failed", "timed_out":
+			if first, ok := firstFailed[*j.StepKey]; !ok || j.RetriesCount < first {
+				firstFailed[*j.StepKey] = j.RetriesCount
+			}
+		case "passed":
+			if last, ok := lastPassed[*j.StepKey]; !ok || j.RetriesCount > last {
+				lastPassed[*j.StepKey] = j.RetriesCount
+			}
+		}
+	}
+
+	flaky := make(map[string]bool)
+	for key, first := range firstFailed {
+		if last, ok := lastPassed[key]; ok && last > first {
+			flaky[key] = true
+		}
+	}
+
+	return flaky
+}
+
+// previousAttempts returns the earlier attempts of a retried job, from the first
+// attempt, following the retried_in_job_id of each attempt
+func previousAttempts(jobs []*buildkite.Job, j *buildkite.Job) []*buildkite.Job {
+	if j.ID == nil || j.RetriesCount == 0 {
+		return nil
+	}
+
+	retriedIn := make(map[string]*buildkite.Job)
+	for _, job := range jobs {
+		if job.RetriedInJobID != "" {
+			retriedIn[job.RetriedInJobID] = job
+		}
+	}
+
+	// bounded by the number of jobs in case of a cycle
+	var attempts []*buildkite.Job
+	id := *j.ID
+	for len(attempts) < len(jobs) {
+		prev, ok := retriedIn[id]
+		if !ok {
+			break
+		}
+		attempts = append([]*buildkite.Job{prev}, attempts...)
+		if prev.ID == nil {
+			break
+		}
+		id = *prev.ID
+	}
+
+	return attempts
+}
+
+// latestAttempts drops the earlier attempts of retried jobs, keeping the job with
+// the highest retry count of each step key. Jobs without a step key are all kept.
+func latestAttempts(jobs []*buildkite.Job) []*buildkite.Job {
+	latest := make(map[string]*buildkite.Job)
+	for _, j := range jobs {
+		if j.StepKey == nil {
+			continue
+		}
+		if l, ok := latest[*j.StepKey]; !ok || j.RetriesCount > l.RetriesCount {
+			latest[*j.StepKey] = j
+		}
+	}
+
+	var result []*buildkite.Job
+	for _, j := range jobs {
+		if j.StepKey == nil || latest[*j.StepKey] == j {
+			result = append(result, j)
+		}
 	}
 
-	jSpan.End(trace.WithTimestamp(j.FinishedAt.Time))
+	return result
 }
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/buildkite/go-buildkite/v3/buildkite"
+)
+
+func TestProcessJobMissingCreatedAt(t *testing.T) {
+	d, exporter := newTestDaemon(t, http.NotFoundHandler())
+
+	start := time.Now().UTC().Truncate(time.Second)
+	b := testBuild("app", "b1", 1, start, start.Add(time.Minute))
+	name, state := "tests", "passed"
+	j := &buildkite.Job{
+		Name:        &name,
+		State:       &state,
+		ScheduledAt: buildkite.NewTimestamp(start.Add(-2 * time.Second)),
+		RunnableAt:  buildkite.NewTimestamp(start.Add(-time.Second)),
+		StartedAt:   buildkite.NewTimestamp(start),
+		FinishedAt:  buildkite.NewTimestamp(start.Add(time.Minute)),
+	}
+
+	d.processJob(context.Background(), d.tracer.Tracer("app"), b, j, jobTimeline{}, nil, false)
+
+	span := spanNamed(t, exporter, "tests")
+	for _, key := range []string{"schedule_duration_ms", "create_duration_ms"} {
+		if _, ok := spanAttribute(span, key); ok {
+			t.Errorf("job without CreatedAt has a %s attribute", key)
+		}
+	}
+	for _, e := range span.Events {
+		if e.Name == "created" {
+			t.Errorf("job without CreatedAt has a created event at %s", e.Time)
+		}
+	}
+	if _, ok := spanAttribute(span, "runnable_duration_ms"); !ok {
+		t.Errorf("job has no runnable_duration_ms attribute")
+	}
+}
+
+func TestProcessJobSoftFailExitStatuses(t *testing.T) {
+	statuses := SoftFailExitStatuses
+	SoftFailExitStatuses = []int{2}
+	t.Cleanup(func() { SoftFailExitStatuses = statuses })
+
+	d, exporter := newTestDaemon(t, http.NotFoundHandler())
+
+	start := time.Now().UTC().Truncate(time.Second)
+	b := testBuild("app", "b1", 1, start, start.Add(time.Minute))
+
+	tests := []struct {
+		name        string
+		exitStatus  *int
+		wantSet     bool
+		wantAllowed bool
+	}{
+		{"passed", buildkite.Int(0), false, false},
+		{"no exit status", nil, false, false},
+		{"allowed", buildkite.Int(2), true, true},
+		{"not allowed", buildkite.Int(1), true, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			name, state := tt.name, "failed"
+			j := &buildkite.Job{
+				Name:       &name,
+				State:      &state,
+				ExitStatus: tt.exitStatus,
+				StartedAt:  buildkite.NewTimestamp(start),
+				FinishedAt: buildkite.NewTimestamp(start.Add(time.Minute)),
+			}
+			d.processJob(context.Background(), d.tracer.Tracer("app"), b, j, jobTimeline{}, nil, false)
+
+			span := spanNamed(t, exporter, tt.name)
+			allowed, ok := spanAttribute(span, "exporter_soft_fail_allowed")
+			_, hasStatuses := spanAttribute(span, "exporter_soft_fail_exit_statuses")
+			if ok != tt.wantSet || hasStatuses != tt.wantSet {
+				t.Fatalf("soft fail attributes set: %t, %t, want %t", ok, hasStatuses, tt.wantSet)
+			}
+			if allowed.AsBool() != tt.wantAllowed {
+				t.Fatalf("exporter_soft_fail_allowed = %t, want %t", allowed.AsBool(), tt.wantAllowed)
+			}
+		})
+	}
+}
+
+func TestJobName(t *testing.T) {
+	name, label, typ, empty := "tests", ":pipeline:", "waiter", ""
+
+	tests := []struct {
+		name string
+		j    *buildkite.Job
+		want string
+	}{
+		{"name", &buildkite.Job{Name: &name, Label: &label, Type: &typ}, "tests"},
+		{"nil name", &buildkite.Job{Label: &label, Type: &typ}, ":pipeline:"},
+		{"empty name and label", &buildkite.Job{Name: &empty, Label: &empty, Type: &typ}, "waiter"},
+		{"nothing", &buildkite.Job{}, "unknown"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := jobName(tt.j); got != tt.want {
+				t.Fatalf("jobName() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAgentMetadataValue(t *testing.T) {
+	metadata := []string{"queue=default", "env=FOO=bar", "spot"}
+
+	tests := []struct {
+		key    string
+		want   string
+		wantOK bool
+	}{
+		{"queue", "default", true},
+		{"env", "FOO=bar", true},
+		{"spot", "", false},
+		{"missing", "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.key, func(t *testing.T) {
+			got, ok := agentMetadataValue(metadata, tt.key)
+			if got != tt.want || ok != tt.wantOK {
+				t.Fatalf("agentMetadataValue(%q) = %q, %t, want %q, %t", tt.key, got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
@@ -1,11 +1,16 @@
 package main
 
 import (
-	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"log"
+	"net"
 	"os"
+	"path"
+	"strconv"
 	"strings"
 	"time"
+	"unicode"
 
 	"github.com/buildkite/go-buildkite/v3/buildkite"
 )
@@ -14,20 +19,445 @@ var (
 	ServiceVersion   = "v0.0.1"
 	ServiceName      = "BuildKiteExporter"
 	ServiceCachePath = "/tmp/buildkite-id-cache.txt"
+	ServiceInstance  = instanceID()
+	CacheDisabled    = os.Getenv("CACHE_DISABLED") == "true"
+	DebugLogging     = os.Getenv("DEBUG") == "true"
+	MetricsAddr      = os.Getenv("METRICS_ADDR")
+	EnablePprof      = os.Getenv("ENABLE_PPROF") == "true"
+	SelfTrace        = os.Getenv("SELF_TRACE") == "true"
+	PollSpan         = os.Getenv("POLL_SPAN") == "true"
+	PollWaitTimeout  = envDurationOrDefault("POLL_WAIT_TIMEOUT", time.Hour)
 
-	BuildKiteApiToken      = os.Getenv("BUILDKITE_TOKEN")
+	// The first poll of run exports builds finishing after startup instead of HoneycombMaxRetention back
+	SkipInitialBackfill = os.Getenv("SKIP_INITIAL_BACKFILL") == "true"
+
+	// Window of builds listed by each poll of the tail command
+	TailWindow = envDurationOrDefault("TAIL_WINDOW", 5*time.Minute)
+
+	// Polls slow down while the export error rate is at least BackpressureErrorRate, 0 disables backpressure
+	BackpressureErrorRate   = envFloatOrDefault("BACKPRESSURE_ERROR_RATE", 0)
+	BackpressureMaxInterval = envDurationOrDefault("BACKPRESSURE_MAX_INTERVAL", time.Hour)
+
+	// Process new builds one at a time from the earliest finished, so that the cut
+	// off point only advances past exported builds
+	OrderedProcessing = os.Getenv("ORDERED_PROCESSING") == "true"
+
+	// Backfills checkpoint their progress every this many exported builds, 0 disables checkpoints
+	BackfillCheckpointEvery = envIntOrDefault("BACKFILL_CHECKPOINT_EVERY", 0)
+
+	// Builds which failed to process are appended to this file to be exported again later
+	DeadLetterFile = os.Getenv("DEAD_LETTER_FILE")
+
+	// Graceful shutdown drains in-flight builds then flushes spans, each phase bounded on its own
+	ShutdownDrainTimeout = envDurationOrDefault("SHUTDOWN_DRAIN_TIMEOUT", 30*time.Second)
+	ShutdownFlushTimeout = envDurationOrDefault("SHUTDOWN_FLUSH_TIMEOUT", 30*time.Second)
+
+	// A bloom filter bounds the memory of the cache, skipping a few new builds as false positives
+	CacheBackend            = envOneOf("CACHE_BACKEND", "set", []string{"set", "bloom"})
+	CacheBloomCapacity      = envIntOrDefault("CACHE_BLOOM_CAPACITY", 1000000)
+	CacheBloomFalsePositive = envFloatOrDefault("CACHE_BLOOM_FALSE_POSITIVE", 0.0001)
+
+	// Poll intervals of pipelines polled more or less often than the global interval
+	PipelinePollIntervals = envDurationMap("PIPELINE_POLL_INTERVALS")
+
+	// Maximum number of pipelines listed in parallel
+	PipelineConcurrency = envIntOrDefault("PIPELINE_CONCURRENCY", 4)
+
+	// A failed poll is retried with exponential backoff before sleeping until the next one
+	PollRetryAttempts = envIntOrDefault("POLL_RETRY_ATTEMPTS", 3)
+	PollRetryBackoff  = envDurationOrDefault("POLL_RETRY_BACKOFF", 30*time.Second)
+
+	// Time spent retrying polls and exports above which a poll logs a warning, 0 disables it
+	RetryBudgetPerPoll = envDurationOrDefault("RETRY_BUDGET_PER_POLL", 10*time.Minute)
+
+	BuildKiteApiToken      = secretFromEnv("BUILDKITE_TOKEN")
 	BuildKiteOrgName       = os.Getenv("BUILDKITE_ORG")
 	BuildKitePipelineName  = os.Getenv("BUILDKITE_PIPELINE")
 	BuildKiteMaxPagination = 100
+	BuildKiteMaxPages      = envIntOrDefault("BUILDKITE_MAX_PAGES", 0)
+	BuildKiteUserAgent     = envOrDefault("BUILDKITE_USER_AGENT", ServiceName+"/"+ServiceVersion)
+
+	// Timeout of each BuildKite API request, 0 disables the timeout
+	BuildKiteRequestTimeout = envDurationOrDefault("BUILDKITE_REQUEST_TIMEOUT", 0)
+
+	// Export all pipelines of a cluster in addition to BUILDKITE_PIPELINE
+	BuildKiteCluster        = os.Getenv("BUILDKITE_CLUSTER")
+	BuildKiteClusterRefresh = envDurationOrDefault("BUILDKITE_CLUSTER_REFRESH", time.Hour)
+
+	// Build states to list, only 'finished' states by default
+	BuildStates = envBuildStates("BUILD_STATES", []string{"passed", "failed", "canceled", "skipped"})
+
+	// Only export builds triggered by these sources, e.g. "schedule", "webhook", "ui", "api"
+	BuildSourceFilter = envList("BUILD_SOURCE_FILTER")
+
+	// Glob patterns of branches to export, exclusions take precedence over inclusions
+	BranchInclude = envGlobList("BRANCH_INCLUDE")
+	BranchExclude = envGlobList("BRANCH_EXCLUDE")
+
+	// Builds shorter than this are noise, skipped builds have zero duration
+	MinBuildDuration = envDurationOrDefault("MIN_BUILD_DURATION", 0)
+
+	// Only export the unhealthy tail of builds to reduce cost
+	FailuresOnly = os.Getenv("FAILURES_ONLY") == "true"
+
+	// Job types to not create spans for, e.g. "waiter", "manual" or "trigger"
+	JobTypeExclude = envList("JOB_TYPE_EXCLUDE")
+
+	// Glob patterns of job names, labels or step keys to not create spans for, e.g. ":buildkite:*"
+	JobNameExclude = envGlobList("JOB_NAME_EXCLUDE")
+
+	// Earlier attempts of retried jobs are still listed alongside their retries
+	JobsLatestAttemptOnly = os.Getenv("JOBS_LATEST_ATTEMPT_ONLY") == "true"
+
+	// Earlier attempts of retried jobs are added as retry events on the job span
+	RetryEvents = os.Getenv("RETRY_EVENTS") == "true"
+
+	// Cap on job spans of a build, 0 is unlimited
+	MaxJobsPerBuild = envIntOrDefault("MAX_JOBS_PER_BUILD", 0)
+
+	// Exit statuses the pipelines' soft_fail rules allow, BuildKite API does not expose the rules
+	SoftFailExitStatuses = envIntList("SOFT_FAIL_EXIT_STATUSES")
+
+	// Fetching build detail costs one API call per build so it is opt-in
+	BuildKiteFetchBuildDetail = os.Getenv("FETCH_BUILD_DETAIL") == "true"
+	BuildKiteMaxConcurrency   = envIntOrDefault("BUILDKITE_MAX_CONCURRENCY", 10)
+
+	// Pipeline details and failures to fetch them are reused by builds for this long
+	PipelineCacheTTL = envDurationOrDefault("PIPELINE_CACHE_TTL", 15*time.Minute)
+
+	// Pipelines whose list results miss jobs, fetched in detail when FETCH_BUILD_DETAIL is not set
+	BuildKiteFetchBuildDetailPipelines = envList("FETCH_BUILD_DETAIL_PIPELINES")
+
+	// List results carry no job count, builds listed with this many jobs could be truncated
+	// and are fetched in detail, 0 disables the check
+	ListedJobsLimit = envIntOrDefault("LISTED_JOBS_LIMIT", 0)
+
+	// Agent metadata are split into key and value on the first separator
+	AgentMetadataSeparator = envOrDefault("AGENT_METADATA_SEPARATOR", "=")
+
+	// Agent metadata promoted to boolean attributes, keyed by attribute name, e.g. "spot=spot"
+	AgentMetadataBools = envMap("AGENT_METADATA_BOOLS")
+
+	// Walking the rebuild chain costs one API call per build in the chain so it is opt-in
+	BuildRebuildMaxDepth = envIntOrDefault("BUILD_REBUILD_MAX_DEPTH", 0)
+
+	// GraphQL API requires the token to have GraphQL scope so it is opt-in
+	BuildKiteGraphQLEnabled  = os.Getenv("BUILDKITE_GRAPHQL_ENABLED") == "true"
+	BuildKiteGraphQLEndPoint = "https://graphql.buildkite.com/v1"
+
+	// Team of pipelines without teams in GraphQL API, or of all pipelines when GraphQL is disabled
+	DefaultTeam = os.Getenv("DEFAULT_TEAM")
+
+	// Test Analytics uses its own API token with read_suites scope
+	TestAnalyticsToken    = secretFromEnv("TEST_ANALYTICS_TOKEN")
+	TestAnalyticsSuite    = os.Getenv("TEST_ANALYTICS_SUITE")
+	TestAnalyticsEnabled  = TestAnalyticsToken != "" && TestAnalyticsSuite != ""
+	TestAnalyticsEndPoint = "https://api.buildkite.com/"
+
+	// Commit messages could be arbitrarily long, only keep their first 256 runes
+	BuildMessageMaxLength = 256
+
+	// Short SHA for readability in trace lists, 0 disables commit_short
+	CommitShortLength = envIntOrDefault("COMMIT_SHORT_LENGTH", 7)
+
+	// Non-string metadata values are dropped unless they could be JSON encoded
+	MetadataJSONFallback = os.Getenv("METADATA_JSON_FALLBACK") == "true"
+	MetadataMaxLength    = 256
 
-	HoneycombEndPoint = "api.honeycomb.io:443"
+	// Build env vars to export, none by default as env could hold secrets
+	BuildEnvAllowlist = envList("BUILD_ENV_ALLOWLIST")
+
+	// Protect against runaway column cardinality from large metadata, 0 means unlimited
+	MaxAttrsPerSpan = envIntOrDefault("MAX_ATTRS_PER_SPAN", 0)
+
+	// Naming convention of attribute keys: ours, or the OpenTelemetry semantic conventions
+	AttributeConventions = envOneOf("ATTRIBUTE_CONVENTIONS", "buildkite", []string{"buildkite", "otel"})
+
+	// Rename or drop attribute keys to align with existing schema conventions
+	AttributeMapping = loadAttributeMapping(AttributeConventions, os.Getenv("ATTRIBUTE_MAPPING_FILE"))
+
+	// Rows of builds or jobs are also written to a CSV file, or TSV when it ends with .tsv
+	ExportCSV     = os.Getenv("EXPORT_CSV")
+	ExportCSVRows = envOneOf("EXPORT_CSV_ROWS", "build", []string{"build", "job"})
+
+	// Attributes set on the resource of every span, e.g. "deployment.environment=prod,team=ci"
+	ResourceAttributes = envMap("RESOURCE_ATTRIBUTES")
+
+	// Whether jobs are nested under their build span or exported as their own traces, see processJob
+	TraceMode = envOneOf("TRACE_MODE", "build", []string{"build", "job"})
+
+	BuildSpanKind = parseSpanKind(envOrDefault("BUILD_SPAN_KIND", "server"))
+	JobSpanKind   = parseSpanKind(envOrDefault("JOB_SPAN_KIND", "internal"))
+
+	HoneycombEndPoint = honeycombEndPoint()
 	HoneycombHeaders  = map[string]string{
-		"x-honeycomb-team":    os.Getenv("HONEYCOMB_API_KEY"),
-		"x-honeycomb-dataset": os.Getenv("HONEYCOMB_DATASET"),
+		"x-honeycomb-team":    secretFromEnv("HONEYCOMB_API_KEY"),
+		"x-honeycomb-dataset": datasetName("HONEYCOMB_DATASET", os.Getenv("HONEYCOMB_DATASET")),
 	}
 	HoneycombMaxRetention = 60 * 24 * time.Hour
+
+	// Standard OTel SDK endpoint env vars replace the Honeycomb endpoint when set
+	OtelEndpointFromEnv = os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") != "" || os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") != ""
+	// the metric exporter does not read the TRACES variable, only these
+	OtelMetricsEndpointFromEnv = os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") != "" || os.Getenv("OTEL_EXPORTER_OTLP_METRICS_ENDPOINT") != ""
+
+	// OTLP exporter retry policy, defaults match the OTel SDK
+	OtlpRetryEnabled         = os.Getenv("OTLP_RETRY_DISABLED") != "true"
+	OtlpRetryInitialInterval = envDurationOrDefault("OTLP_RETRY_INITIAL_INTERVAL", 5*time.Second)
+	OtlpRetryMaxInterval     = envDurationOrDefault("OTLP_RETRY_MAX_INTERVAL", 30*time.Second)
+	OtlpRetryMaxElapsedTime  = envDurationOrDefault("OTLP_RETRY_MAX_ELAPSED_TIME", time.Minute)
+
+	// gRPC keepalive pings of the OTLP connection, 0 disables them
+	OtlpKeepaliveTime    = envDurationOrDefault("OTLP_KEEPALIVE_TIME", 0)
+	OtlpKeepaliveTimeout = envDurationOrDefault("OTLP_KEEPALIVE_TIMEOUT", 20*time.Second)
+
+	// Build and job duration histograms are exported as OTLP metrics alongside spans
+	OtlpMetricsEnabled      = os.Getenv("OTLP_METRICS_ENABLED") == "true"
+	OtlpMetricsInterval     = envDurationOrDefault("OTLP_METRICS_INTERVAL", time.Minute)
+	HoneycombMetricsDataset = datasetName("HONEYCOMB_METRICS_DATASET", os.Getenv("HONEYCOMB_METRICS_DATASET"))
+
+	// Minimum level of the OTel SDK's own logs, one of none, error, info or debug
+	OtelLogLevel = envOneOf("OTEL_SDK_LOG_LEVEL", "error", []string{"none", "error", "info", "debug"})
+
+	// Route pipelines to their own dataset, other pipelines use HONEYCOMB_DATASET
+	HoneycombPipelineDatasets = envDatasetMap("HONEYCOMB_PIPELINE_DATASETS")
+
+	// Spans are fanned out to every target, e.g. to double-write during a team migration
+	ExportTargets = loadExportTargets(os.Getenv("EXPORT_TARGETS_FILE"))
 )
 
+// debugf logs only when DebugLogging is enabled
+func debugf(format string, v ...interface{}) {
+	if DebugLogging {
+		log.Printf(format, v...)
+	}
+}
+
+// envOrDefault returns the value of the env var or fallback when it is unset
+func envOrDefault(name, fallback string) string {
+	if v, ok := os.LookupEnv(name); ok && v != "" {
+		return v
+	}
+
+	return fallback
+}
+
+// envIntOrDefault returns the integer value of the env var or fallback when it is unset
+func envIntOrDefault(name string, fallback int) int {
+	v := os.Getenv(name)
+	if v == "" {
+		return fallback
+	}
+
+	i, err := strconv.Atoi(v)
+	if err != nil {
+		log.Fatalf("invalid %s: %v\n", name, err)
+	}
+
+	return i
+}
+
+// envFloatOrDefault returns the float value of the env var or fallback when it is unset
+func envFloatOrDefault(name string, fallback float64) float64 {
+	v := os.Getenv(name)
+	if v == "" {
+		return fallback
+	}
+
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		log.Fatalf("invalid %s: %v\n", name, err)
+	}
+
+	return f
+}
+
+// envDurationOrDefault returns the duration value of the env var or fallback when it is unset
+func envDurationOrDefault(name string, fallback time.Duration) time.Duration {
+	v := os.Getenv(name)
+	if v == "" {
+		return fallback
+	}
+
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		log.Fatalf("invalid %s: %v\n", name, err)
+	}
+
+	return d
+}
+
+// envList returns the comma-separated values of the env var, ignoring empty values
+func envList(name string) []string {
+	var result []string
+	for _, v := range strings.Split(os.Getenv(name), ",") {
+		v = strings.TrimSpace(v)
+		if v != "" {
+			result = append(result, v)
+		}
+	}
+
+	return result
+}
+
+// envIntList returns the comma-separated integer values of the env var
+func envIntList(name string) []int {
+	var result []int
+	for _, v := range envList(name) {
+		i, err := strconv.Atoi(v)
+		if err != nil {
+			log.Fatalf("invalid %s: %v\n", name, err)
+		}
+		result = append(result, i)
+	}
+
+	return result
+}
+
+// envMap returns the comma-separated key=value pairs of the env var
+func envMap(name string) map[string]string {
+	result := make(map[string]string)
+	for _, kv := range envList(name) {
+		token := strings.SplitN(kv, "=", 2)
+		if len(token) != 2 || token[0] == "" || token[1] == "" {
+			log.Fatalf("invalid %s entry %q, expected key=value\n", name, kv)
+		}
+		result[strings.TrimSpace(token[0])] = strings.TrimSpace(token[1])
+	}
+
+	return result
+}
+
+// envDatasetMap returns the comma-separated pipeline=dataset pairs of the env var
+// with normalized dataset names
+func envDatasetMap(name string) map[string]string {
+	result := envMap(name)
+	for pipeline, dataset := range result {
+		result[pipeline] = datasetName(name, dataset)
+	}
+
+	return result
+}
+
+// datasetName trims surrounding whitespace from a Honeycomb dataset name and warns
+// when the name would likely be rejected or renamed by Honeycomb
+func datasetName(name, dataset string) string {
+	normalized := strings.TrimSpace(dataset)
+	if normalized != dataset {
+		log.Printf("warning: %s dataset %q has surrounding whitespace, using %q", name, dataset, normalized)
+	}
+	if normalized == "" {
+		return normalized
+	}
+
+	if len(normalized) > 255 {
+		log.Printf("warning: %s dataset %q is longer than 255 characters", name, normalized)
+	}
+	for _, r := range normalized {
+		if !(unicode.IsLetter(r) || unicode.IsDigit(r) || strings.ContainsRune(" -_.", r)) {
+			log.Printf("warning: %s dataset %q contains %q, only letters, digits, spaces, '-', '_' and '.' are expected", name, normalized, r)
+			break
+		}
+	}
+
+	return normalized
+}
+
+// envDurationMap returns the comma-separated key=duration pairs of the env var
+func envDurationMap(name string) map[string]time.Duration {
+	result := make(map[string]time.Duration)
+	for k, v := range envMap(name) {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			log.Fatalf("invalid %s entry %s=%s: %v\n", name, k, v, err)
+		}
+		result[k] = d
+	}
+
+	return result
+}
+
+// envBuildStates returns the comma-separated build states of the env var or fallback
+// when it is unset, failing early on states unknown to BuildKite
+func envBuildStates(name string, fallback []string) []string {
+	states := envList(name)
+	if len(states) == 0 {
+		return fallback
+	}
+
+	// Possible values are: running, scheduled, passed, failed, canceled, skipped and not_run.
+	valid := []string{"running", "scheduled", "passed", "failed", "canceled", "skipped", "not_run"}
+	for _, state := range states {
+		if !contains(valid, state) {
+			log.Fatalf("invalid %s state %q, expected one of %v\n", name, state, valid)
+		}
+	}
+
+	return states
+}
+
+// envOneOf returns the value of the env var or fallback when it is unset,
+// failing early on values not in valid
+func envOneOf(name, fallback string, valid []string) string {
+	v := envOrDefault(name, fallback)
+	if !contains(valid, v) {
+		log.Fatalf("invalid %s %q, expected one of %v\n", name, v, valid)
+	}
+
+	return v
+}
+
+// envGlobList returns the comma-separated glob patterns of the env var,
+// failing early on malformed patterns
+func envGlobList(name string) []string {
+	patterns := envList(name)
+	for _, p := range patterns {
+		if _, err := path.Match(p, ""); err != nil {
+			log.Fatalf("invalid %s pattern %q: %v\n", name, p, err)
+		}
+	}
+
+	return patterns
+}
+
+// secretFromEnv reads a secret from the file pointed to by <name>_FILE,
+// falling back to the <name> env var when it is not set
+func secretFromEnv(name string) string {
+	path := os.Getenv(name + "_FILE")
+	if path == "" {
+		return os.Getenv(name)
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		log.Fatalf("failed to read %s_FILE: %v\n", name, err)
+	}
+
+	return strings.TrimSpace(string(content))
+}
+
+// honeycombEndPoint returns the OTLP endpoint from HONEYCOMB_API_ENDPOINT,
+// or the endpoint of HONEYCOMB_REGION, defaulting to the US instance
+func honeycombEndPoint() string {
+	endpoint := os.Getenv("HONEYCOMB_API_ENDPOINT")
+	if endpoint == "" {
+		switch region := envOrDefault("HONEYCOMB_REGION", "us"); region {
+		case "us":
+			endpoint = "api.honeycomb.io:443"
+		case "eu":
+			endpoint = "api.eu1.honeycomb.io:443"
+		default:
+			log.Fatalf("invalid HONEYCOMB_REGION %q, expected us or eu\n", region)
+		}
+	}
+
+	if _, _, err := net.SplitHostPort(endpoint); err != nil {
+		log.Fatalf("invalid Honeycomb endpoint %q, expected host:port: %v\n", endpoint, err)
+	}
+
+	return endpoint
+}
+
 // init buildkite client
 func initBuildKiteClient() *buildkite.Client {
 	config, err := buildkite.NewTokenConfig(BuildKiteApiToken, false)
@@ -35,20 +465,72 @@ func initBuildKiteClient() *buildkite.Client {
 		log.Fatalf("failed to init BuildKite client: %v\n", err)
 	}
 
-	return buildkite.NewClient(config.Client())
+	httpClient := config.Client()
+	httpClient.Timeout = BuildKiteRequestTimeout
+	httpClient.Transport = newRetryCountingTransport(httpClient.Transport)
+
+	client := buildkite.NewClient(httpClient)
+	client.UserAgent = BuildKiteUserAgent
+
+	return client
 }
 
-func main() {
-	// init bk client
-	ctx := context.Background()
-	bk := initBuildKiteClient()
+// instanceID identifies this exporter replica from EXPORTER_INSTANCE_ID or HOSTNAME,
+// falling back to a random ID
+func instanceID() string {
+	if id := envOrDefault("EXPORTER_INSTANCE_ID", os.Getenv("HOSTNAME")); id != "" {
+		return id
+	}
+
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		log.Fatalf("failed to generate instance ID: %v\n", err)
+	}
 
-	tracer, shutdown := initOtel(ctx, ServiceName)
-	defer shutdown()
+	return hex.EncodeToString(b)
+}
 
-	sleepDuration := 15 * time.Minute
+// redact masks a secret while still showing whether it was set
+func redact(secret string) string {
+	if secret == "" {
+		return "<unset>"
+	}
 
-	pipelines := strings.Split(BuildKitePipelineName, ",")
+	return "<redacted>"
+}
 
-	NewDaemon(tracer, bk, pipelines, sleepDuration, ServiceCachePath).Exec(ctx)
+// logConfig prints the parsed configuration with secrets masked
+func logConfig(pipelines []string, sleepDuration time.Duration) {
+	log.Printf("%s %s (instance %s) starting with config:", ServiceName, ServiceVersion, ServiceInstance)
+	log.Printf("  buildkite org: %q", BuildKiteOrgName)
+	log.Printf("  buildkite pipelines: %q", pipelines)
+	log.Printf("  buildkite cluster: %q", BuildKiteCluster)
+	log.Printf("  build states: %q", BuildStates)
+	log.Printf("  buildkite token: %s", redact(BuildKiteApiToken))
+	log.Printf("  buildkite graphql enabled: %t", BuildKiteGraphQLEnabled)
+	if !BuildKiteGraphQLEnabled && !BuildKiteFetchBuildDetail && ListedJobsLimit == 0 {
+		log.Printf("  WARNING: builds whose job list is truncated by list results cannot be detected, their missing jobs are not exported. Set BUILDKITE_GRAPHQL_ENABLED, FETCH_BUILD_DETAIL or LISTED_JOBS_LIMIT")
+	}
+	log.Printf("  test analytics suite: %q (token: %s)", TestAnalyticsSuite, redact(TestAnalyticsToken))
+	log.Printf("  poll interval: %s", sleepDuration)
+	log.Printf("  workers: %d pipelines, %d BuildKite API calls", PipelineConcurrency, BuildKiteMaxConcurrency)
+	log.Printf("  pipeline poll intervals: %v", PipelinePollIntervals)
+	log.Printf("  trace mode: %s", TraceMode)
+	log.Printf("  cache path: %s (disabled: %t, backend: %s)", ServiceCachePath, CacheDisabled, CacheBackend)
+	log.Printf("  honeycomb endpoint: %s (overridden by OTEL_EXPORTER_OTLP_*: %t)", HoneycombEndPoint, OtelEndpointFromEnv)
+	log.Printf("  honeycomb dataset: %q", HoneycombHeaders["x-honeycomb-dataset"])
+	log.Printf("  honeycomb pipeline datasets: %v", HoneycombPipelineDatasets)
+	log.Printf("  otlp metrics enabled: %t (dataset: %q)", OtlpMetricsEnabled, HoneycombMetricsDataset)
+	log.Printf("  honeycomb api key: %s", redact(HoneycombHeaders["x-honeycomb-team"]))
+	for _, t := range ExportTargets {
+		log.Printf("  export target: %q (api key: %s)", t.Endpoint, redact(t.Headers["x-honeycomb-team"]))
+	}
+	log.Printf("  resource attributes: %v", ResourceAttributes)
+	log.Printf("  otel sdk log level: %s", OtelLogLevel)
+	log.Printf("  csv export: %q (rows: %s)", ExportCSV, ExportCSVRows)
+	log.Printf("  metrics addr: %q", MetricsAddr)
+}
+
+func main() {
+	dispatch(os.Args[1:])
 }
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/pprof"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"google.golang.org/grpc"
+)
+
+// metrics are published as expvar and served on /debug/vars when MetricsAddr is set
+var (
+	// skippedBuilds counts builds skipped because they were found in cache, keyed by pipeline
+	skippedBuilds = expvar.NewMap("skipped_builds")
+
+	// span counters around the batch span processor, see countingExporter
+	spansEnded    = expvar.NewInt("spans_ended")
+	spansExported = expvar.NewInt("spans_exported")
+	spansFailed   = expvar.NewInt("spans_failed")
+	spansDropped  = expvar.NewInt("spans_dropped")
+
+	// retries and the time spent on them, keyed by category: poll, buildkite_api or otlp_export
+	retries  = expvar.NewMap("retries")
+	retryMs  = expvar.NewMap("retry_ms")
+	retryAll int64 // nanoseconds spent retrying across categories, compared against RetryBudgetPerPoll
+
+	// exportLag is the time from the last exported build of each pipeline finishing
+	// until it was exported, keyed by pipeline
+	exportLag = expvar.NewMap("export_lag_seconds")
+)
+
+// OTel histograms exported over OTLP when OtlpMetricsEnabled is set, one per export target
+var (
+	buildDurations []metric.Float64Histogram
+	jobDurations   []metric.Float64Histogram
+	exportLags     []metric.Float64Histogram
+)
+
+// recordDuration records d in seconds on every histogram
+func recordDuration(ctx context.Context, histograms []metric.Float64Histogram, d time.Duration, attrs ...attribute.KeyValue) {
+	for _, h := range histograms {
+		h.Record(ctx, d.Seconds(), attrs...)
+	}
+}
+
+// recordExportLag records how long after finishing the build of pipeline is exported
+func recordExportLag(ctx context.Context, pipeline string, finishedAt time.Time) {
+	lag := time.Since(finishedAt)
+
+	v := new(expvar.Float)
+	v.Set(lag.Seconds())
+	exportLag.Set(pipeline, v)
+
+	recordDuration(ctx, exportLags, lag, attribute.String("pipeline", pipeline))
+}
+
+func init() {
+	// spans_queued is the number of spans waiting in the batch span processors or being exported
+	expvar.Publish("spans_queued", expvar.Func(func() interface{} {
+		return spansQueued()
+	}))
+}
+
+// spansQueued returns the number of spans waiting in the export queues or being exported
+func spansQueued() int64 {
+	return spansEnded.Value() - spansDropped.Value() - spansExported.Value() - spansFailed.Value()
+}
+
+// serveMetrics exposes the expvar metrics, and pprof profiles when enabled, over HTTP in the background
+func serveMetrics(addr string) {
+	if addr == "" {
+		return
+	}
+
+	// a dedicated mux so that pprof handlers are only served when enabled
+	mux := http.NewServeMux()
+	mux.Handle("/debug/vars", expvar.Handler())
+	mux.HandleFunc("/metrics", servePrometheus)
+	if EnablePprof {
+		mux.HandleFunc("/debug/pprof/", pprof.Index)
+		mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+		mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	}
+
+	go func() {
+		log.Printf("serving metrics on %s/debug/vars and %s/metrics (pprof: %t)", addr, addr, EnablePprof)
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			log.Printf("metrics server stopped: %v", err)
+		}
+	}()
+}
+
+// servePrometheus serves the metrics in the Prometheus text exposition format
+func servePrometheus(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	writePromValue(w, "spans_ended_total", "counter", "Spans handed to the export queues, counted once per export target", spansEnded)
+	writePromValue(w, "spans_exported_total", "counter", "Spans exported successfully", spansExported)
+	writePromValue(w, "spans_failed_total", "counter", "Spans that failed to export", spansFailed)
+	writePromValue(w, "spans_dropped_total", "counter", "Spans dropped because their export queue was full", spansDropped)
+	writePromValue(w, "spans_queued", "gauge", "Spans waiting in the export queues or being exported", expvar.Func(func() interface{} { return spansQueued() }))
+	writePromValue(w, "dead_letters_total", "counter", "Builds which failed to process", deadLetters)
+	writePromMap(w, "skipped_builds_total", "counter", "Builds skipped because they were already exported", "pipeline", skippedBuilds)
+	writePromMap(w, "retries_total", "counter", "Retries per category", "category", retries)
+	writePromMap(w, "retry_milliseconds_total", "counter", "Time spent on retries per category", "category", retryMs)
+	writePromMap(w, "export_lag_seconds", "gauge", "Time from the last exported build finishing until it was exported", "pipeline", exportLag)
+}
+
+// writePromValue writes a metric without labels, prefixed with buildkite_exporter_
+func writePromValue(w io.Writer, name, kind, help string, v expvar.Var) {
+	name = "buildkite_exporter_" + name
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %s\n", name, help, name, kind, name, v.String())
+}
+
+// writePromMap writes a metric with one series per key of m, as the value of label
+func writePromMap(w io.Writer, name, kind, help, label string, m *expvar.Map) {
+	name = "buildkite_exporter_" + name
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+	m.Do(func(kv expvar.KeyValue) {
+		fmt.Fprintf(w, "%s{%s=%q} %s\n", name, label, kv.Key, kv.Value.String())
+	})
+}
+
+// recordRetry accounts n retries of a category that took d in total,
+// including the backoff waited before them
+func recordRetry(category string, n int64, d time.Duration) {
+	retries.Add(category, n)
+	retryMs.Add(category, d.Milliseconds())
+	atomic.AddInt64(&retryAll, int64(d))
+}
+
+// retryTime returns the total time spent retrying since the process started
+func retryTime() time.Duration {
+	return time.Duration(atomic.LoadInt64(&retryAll))
+}
+
+// retryCountingTransport counts the retries of BuildKite API requests, which the
+// BuildKite client makes with the same request after a 429 response
+type retryCountingTransport struct {
+	http.RoundTripper
+
+	mu sync.Mutex
+	// when the last attempt of each request rate limited ended
+	limited map[*http.Request]time.Time
+}
+
+func newRetryCountingTransport(rt http.RoundTripper) *retryCountingTransport {
+	if rt == nil {
+		rt = http.DefaultTransport
+	}
+
+	return &retryCountingTransport{RoundTripper: rt, limited: make(map[*http.Request]time.Time)}
+}
+
+func (t *retryCountingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.RoundTripper.RoundTrip(req)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if lastEnd, ok := t.limited[req]; ok {
+		recordRetry("buildkite_api", 1, time.Since(lastEnd))
+		delete(t.limited, req)
+	}
+	if err == nil && resp.StatusCode == http.StatusTooManyRequests {
+		t.limited[req] = time.Now()
+	}
+
+	return resp, err
+}
+
+// countingProcessor counts the spans handed to the batch span processors,
+// once per processor as each export target has its own queue.
+// Like the batch span processors, it ignores spans which are not sampled.
+type countingProcessor struct {
+	queues int64
+}
+
+func (countingProcessor) OnStart(context.Context, sdktrace.ReadWriteSpan) {}
+func (countingProcessor) Shutdown(context.Context) error                  { return nil }
+func (countingProcessor) ForceFlush(context.Context) error                { return nil }
+
+func (p countingProcessor) OnEnd(s sdktrace.ReadOnlySpan) {
+	if s.SpanContext().IsSampled() {
+		spansEnded.Add(p.queues)
+	}
+}
+
+// maxQueuedSpans is the number of spans a batch span processor holds by default,
+// its queue plus the batch being exported
+const maxQueuedSpans = sdktrace.DefaultMaxQueueSize + sdktrace.DefaultMaxExportBatchSize
+
+// boundedProcessor wraps a batch span processor and counts the spans it drops in
+// spansDropped, as the batch span processor does not expose them.
+//
+// The batch span processor blocks rather than drops when its queue is full, and its
+// queue is sized so that it never is: boundedProcessor drops spans once maxQueuedSpans
+// of them are waiting in the queue or being exported, as the batch span processor
+// would by default.
+type boundedProcessor struct {
+	sdktrace.SpanProcessor
+	queued *int64
+}
+
+func newBoundedProcessor(exp sdktrace.SpanExporter) boundedProcessor {
+	queued := new(int64)
+	return boundedProcessor{
+		SpanProcessor: sdktrace.NewBatchSpanProcessor(
+			countingExporter{exp, queued},
+			sdktrace.WithMaxQueueSize(maxQueuedSpans),
+			sdktrace.WithBlocking(),
+		),
+		queued: queued,
+	}
+}
+
+func (p boundedProcessor) OnEnd(s sdktrace.ReadOnlySpan) {
+	// the batch span processor ignores spans which are not sampled
+	if !s.SpanContext().IsSampled() {
+		return
+	}
+
+	for {
+		n := atomic.LoadInt64(p.queued)
+		if n >= maxQueuedSpans {
+			spansDropped.Add(1)
+			return
+		}
+		if atomic.CompareAndSwapInt64(p.queued, n, n+1) {
+			break
+		}
+	}
+	p.SpanProcessor.OnEnd(s)
+}
+
+// countingExporter counts the spans exported by the wrapped exporter,
+// and releases them from the queue of their boundedProcessor once exported
+type countingExporter struct {
+	sdktrace.SpanExporter
+	queued *int64
+}
+
+func (e countingExporter) ExportSpans(ctx context.Context, spans []sdktrace.ReadOnlySpan) error {
+	defer atomic.AddInt64(e.queued, -int64(len(spans)))
+
+	attempts := &exportAttempts{}
+	err := e.SpanExporter.ExportSpans(context.WithValue(ctx, exportAttemptsKey{}, attempts), spans)
+	if err != nil {
+		spansFailed.Add(int64(len(spans)))
+	} else {
+		spansExported.Add(int64(len(spans)))
+	}
+
+	// the OTLP exporter retries within ExportSpans, every attempt after the first is a retry
+	attempts.mu.Lock()
+	defer attempts.mu.Unlock()
+	if attempts.count > 1 {
+		recordRetry("otlp_export", attempts.count-1, time.Since(attempts.firstEnd))
+	}
+
+	return err
+}
+
+type exportAttemptsKey struct{}
+
+// exportAttempts counts the gRPC calls made by one ExportSpans call
+type exportAttempts struct {
+	mu       sync.Mutex
+	count    int64
+	firstEnd time.Time
+}
+
+// countExportAttempts is a gRPC interceptor counting the export attempts
+// of the ExportSpans call found in ctx
+func countExportAttempts(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	err := invoker(ctx, method, req, reply, cc, opts...)
+
+	if attempts, ok := ctx.Value(exportAttemptsKey{}).(*exportAttempts); ok {
+		attempts.mu.Lock()
+		defer attempts.mu.Unlock()
+		attempts.count++
+		if attempts.count == 1 {
+			attempts.firstEnd = time.Now()
+		}
+	}
+
+	return err
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/buildkite/go-buildkite/v3/buildkite"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestBoundedProcessorDropsWhenFull(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	p := newBoundedProcessor(exporter)
+	defer p.Shutdown(context.Background())
+
+	span := tracetest.SpanStub{
+		Name: "build",
+		SpanContext: trace.NewSpanContext(trace.SpanContextConfig{
+			TraceID:    trace.TraceID{1},
+			SpanID:     trace.SpanID{1},
+			TraceFlags: trace.FlagsSampled,
+		}),
+	}.Snapshot()
+
+	dropped := spansDropped.Value()
+	*p.queued = maxQueuedSpans
+	p.OnEnd(span)
+	if n := spansDropped.Value() - dropped; n != 1 {
+		t.Fatalf("spans_dropped increased by %d on a full queue, want 1", n)
+	}
+
+	*p.queued = 0
+	p.OnEnd(span)
+	if err := p.ForceFlush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if n := spansDropped.Value() - dropped; n != 1 {
+		t.Fatalf("spans_dropped increased by %d, want 1", n)
+	}
+	if n := len(exporter.GetSpans()); n != 1 {
+		t.Fatalf("exported %d spans, want 1", n)
+	}
+	if *p.queued != 0 {
+		t.Fatalf("%d spans still queued after export", *p.queued)
+	}
+}
+
+func TestCountingProcessorSkipsUnsampledSpans(t *testing.T) {
+	p := countingProcessor{queues: 2}
+	span := func(flags trace.TraceFlags) sdktrace.ReadOnlySpan {
+		return tracetest.SpanStub{
+			Name: "build",
+			SpanContext: trace.NewSpanContext(trace.SpanContextConfig{
+				TraceID:    trace.TraceID{1},
+				SpanID:     trace.SpanID{1},
+				TraceFlags: flags,
+			}),
+		}.Snapshot()
+	}
+
+	ended := spansEnded.Value()
+	p.OnEnd(span(0))
+	if n := spansEnded.Value() - ended; n != 0 {
+		t.Fatalf("spans_ended increased by %d for an unsampled span, want 0", n)
+	}
+
+	p.OnEnd(span(trace.FlagsSampled))
+	if n := spansEnded.Value() - ended; n != 2 {
+		t.Fatalf("spans_ended increased by %d, want 2", n)
+	}
+}
+
+func TestServePrometheus(t *testing.T) {
+	skippedBuilds.Add("app", 0)
+
+	w := httptest.NewRecorder()
+	servePrometheus(w, httptest.NewRequest("GET", "/metrics", nil))
+
+	body := w.Body.String()
+	for _, want := range []string{
+		"# TYPE buildkite_exporter_spans_dropped_total counter\n",
+		"\nbuildkite_exporter_spans_dropped_total ",
+		"# TYPE buildkite_exporter_spans_queued gauge\n",
+		"\nbuildkite_exporter_skipped_builds_total{pipeline=\"app\"} ",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("metrics do not contain %q:\n%s", want, body)
+		}
+	}
+}
+
+func TestRetryCountingTransportCountsRateLimitedRetries(t *testing.T) {
+	var calls int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls == 1 {
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.Write([]byte(`{"slug": "app"}`))
+	}))
+	defer server.Close()
+
+	client := buildkite.NewClient(&http.Client{Transport: newRetryCountingTransport(server.Client().Transport)})
+	client.BaseURL, _ = url.Parse(server.URL + "/")
+
+	before := int64(0)
+	if v, ok := retries.Get("buildkite_api").(*expvar.Int); ok {
+		before = v.Value()
+	}
+	if _, _, err := client.Pipelines.Get("org", "app"); err != nil {
+		t.Fatal(err)
+	}
+	if n := retries.Get("buildkite_api").(*expvar.Int).Value() - before; n != 1 {
+		t.Fatalf("buildkite_api retries increased by %d, want 1", n)
+	}
+}
@@ -2,42 +2,327 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"log"
+	"os"
+	"strings"
+	"time"
 
+	"github.com/go-logr/logr"
+	"github.com/go-logr/stdr"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetricgrpc"
 	"go.opentelemetry.io/otel/exporters/otlp/otlptrace"
 	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
 	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/metric/unit"
+	"go.opentelemetry.io/otel/sdk/export/metric/aggregation"
+	"go.opentelemetry.io/otel/sdk/metric/aggregator/histogram"
+	controller "go.opentelemetry.io/otel/sdk/metric/controller/basic"
+	processor "go.opentelemetry.io/otel/sdk/metric/processor/basic"
+	"go.opentelemetry.io/otel/sdk/metric/selector/simple"
 	"go.opentelemetry.io/otel/sdk/resource"
 	sdktrace "go.opentelemetry.io/otel/sdk/trace"
 	semconv "go.opentelemetry.io/otel/semconv/v1.7.0"
 	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/keepalive"
 )
 
-func newExporter(ctx context.Context) (*otlptrace.Exporter, error) {
+// tracerRouter routes the spans of each pipeline to the tracer exporting to its dataset
+type tracerRouter struct {
+	defaultTracer   trace.Tracer
+	pipelineTracers map[string]trace.Tracer
+	internalTracer  trace.Tracer
+}
+
+// Internal returns the tracer of the exporter's own operations, a no-op tracer unless SelfTrace is set
+func (r *tracerRouter) Internal() trace.Tracer {
+	return r.internalTracer
+}
+
+// startCall starts an internal span around a call bounded by timeout. The returned
+// function ends it with the call's error, recording how long the call took relative
+// to its timeout so that slow calls show up before they start failing.
+func (r *tracerRouter) startCall(ctx context.Context, name string, timeout time.Duration, attrs ...attribute.KeyValue) (context.Context, func(err error, attrs ...attribute.KeyValue)) {
+	ctx, span := r.internalTracer.Start(ctx, name, trace.WithAttributes(attrs...))
+	start := time.Now()
+
+	return ctx, func(err error, attrs ...attribute.KeyValue) {
+		elapsed := time.Since(start)
+		span.SetAttributes(attrs...)
+		span.SetAttributes(attribute.Int64("elapsed_ms", elapsed.Milliseconds()))
+		if timeout > 0 {
+			span.SetAttributes(
+				attribute.Int64("timeout_ms", timeout.Milliseconds()),
+				attribute.Float64("timeout_used", float64(elapsed)/float64(timeout)),
+			)
+		}
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+	}
+}
+
+type selfSpanKey struct{}
+
+// withSelfSpan carries the internal span of selfCtx in ctx, so that the internal spans
+// of calls made for the builds processed with ctx become its children, see selfContext
+func withSelfSpan(ctx, selfCtx context.Context) context.Context {
+	return context.WithValue(ctx, selfSpanKey{}, trace.SpanFromContext(selfCtx))
+}
+
+// selfContext returns ctx with the internal span it carries as the current span instead
+// of the build spans, which must not parent internal spans
+func selfContext(ctx context.Context) context.Context {
+	if span, ok := ctx.Value(selfSpanKey{}).(trace.Span); ok {
+		return trace.ContextWithSpan(ctx, span)
+	}
+
+	return trace.ContextWithSpanContext(ctx, trace.SpanContext{})
+}
+
+// Tracer returns the tracer of the pipeline's dataset, falling back to the default dataset
+func (r *tracerRouter) Tracer(pipeline string) trace.Tracer {
+	if t, ok := r.pipelineTracers[pipeline]; ok {
+		return t
+	}
+
+	return r.defaultTracer
+}
+
+// exportTarget is an OTLP endpoint with the headers of the Honeycomb team to export to
+type exportTarget struct {
+	Endpoint string            `json:"endpoint"`
+	Headers  map[string]string `json:"headers"`
+}
+
+// loadExportTargets reads the export targets from a JSON file such as:
+//
+//	[
+//	  {"endpoint": "api.honeycomb.io:443", "headers": {"x-honeycomb-team": "${OLD_API_KEY}"}},
+//	  {"endpoint": "api.honeycomb.io:443", "headers": {"x-honeycomb-team": "${NEW_API_KEY}"}}
+//	]
+//
+// Header values are expanded from env vars so that API keys need not live in the file.
+// Without a file, the only target is the Honeycomb endpoint configured from env vars.
+func loadExportTargets(path string) []exportTarget {
+	if path == "" {
+		target := exportTarget{Headers: HoneycombHeaders}
+		// the OTel SDK reads the standard endpoint env vars itself,
+		// explicit options would take precedence over them
+		if !OtelEndpointFromEnv {
+			target.Endpoint = HoneycombEndPoint
+		}
+		return []exportTarget{target}
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		log.Fatalf("failed to read export targets: %v\n", err)
+	}
+
+	var targets []exportTarget
+	if err := json.Unmarshal(content, &targets); err != nil {
+		log.Fatalf("failed to parse export targets: %v\n", err)
+	}
+	if len(targets) == 0 {
+		log.Fatalf("no export targets in %s\n", path)
+	}
+	for i, t := range targets {
+		if t.Endpoint == "" {
+			log.Fatalf("export target %d has no endpoint\n", i)
+		}
+		for k, v := range t.Headers {
+			t.Headers[k] = os.ExpandEnv(v)
+		}
+	}
+
+	return targets
+}
+
+// headersFor returns the headers sent to the target for dataset, an empty dataset
+// keeping the dataset header of the target
+func (t exportTarget) headersFor(dataset string) map[string]string {
+	headers := make(map[string]string, len(t.Headers)+1)
+	for k, v := range t.Headers {
+		headers[k] = v
+	}
+	if dataset != "" {
+		headers["x-honeycomb-dataset"] = dataset
+	}
+
+	return headers
+}
+
+// newExporter creates an exporter to target, sending spans to dataset unless it is empty
+// in which case the dataset header of the target is used
+func newExporter(ctx context.Context, target exportTarget, dataset string) (*otlptrace.Exporter, error) {
 	opts := []otlptracegrpc.Option{
-		otlptracegrpc.WithEndpoint(HoneycombEndPoint),
-		otlptracegrpc.WithHeaders(HoneycombHeaders),
-		otlptracegrpc.WithTLSCredentials(credentials.NewClientTLSFromCert(nil, "")),
+		otlptracegrpc.WithHeaders(target.headersFor(dataset)),
+		otlptracegrpc.WithDialOption(grpc.WithUnaryInterceptor(countExportAttempts)),
+		// backoff is jittered and honors the throttle delay sent with RESOURCE_EXHAUSTED errors
+		otlptracegrpc.WithRetry(otlptracegrpc.RetryConfig{
+			Enabled:         OtlpRetryEnabled,
+			InitialInterval: OtlpRetryInitialInterval,
+			MaxInterval:     OtlpRetryMaxInterval,
+			MaxElapsedTime:  OtlpRetryMaxElapsedTime,
+		}),
+	}
+
+	// keep idle connections alive between polls so intermediaries do not drop them
+	if OtlpKeepaliveTime > 0 {
+		opts = append(opts, otlptracegrpc.WithDialOption(grpc.WithKeepaliveParams(keepalive.ClientParameters{
+			Time:                OtlpKeepaliveTime,
+			Timeout:             OtlpKeepaliveTimeout,
+			PermitWithoutStream: true,
+		})))
+	}
+
+	if target.Endpoint != "" {
+		opts = append(opts,
+			otlptracegrpc.WithEndpoint(target.Endpoint),
+			otlptracegrpc.WithTLSCredentials(credentials.NewClientTLSFromCert(nil, "")),
+		)
 	}
 
 	client := otlptracegrpc.NewClient(opts...)
 	return otlptrace.New(ctx, client)
 }
 
-// newTraceProvider create a trace provider
-func newTraceProvider(exp *otlptrace.Exporter) *sdktrace.TracerProvider {
+// newResource describes the exporter on every span and metric
+func newResource() *resource.Resource {
+	// custom attributes come first so that they cannot replace the service attributes
+	var attrs []attribute.KeyValue
+	for k, v := range ResourceAttributes {
+		attrs = append(attrs, attribute.String(k, v))
+	}
+
 	// The service.name attribute is required.
-	res := resource.NewWithAttributes(
-		semconv.SchemaURL,
+	attrs = append(attrs,
 		semconv.ServiceNameKey.String(ServiceName),
 		semconv.ServiceVersionKey.String(ServiceVersion),
+		// helps spotting replicas double-exporting the same builds
+		attribute.String("exporter.instance", ServiceInstance),
+	)
+	res := resource.NewWithAttributes(semconv.SchemaURL, attrs...)
+
+	// OTEL_SERVICE_NAME and OTEL_RESOURCE_ATTRIBUTES take precedence
+	res, err := resource.Merge(res, resource.Environment())
+	if err != nil {
+		log.Fatalf("failed to merge resource attributes from env: %v\n", err)
+	}
+
+	return res
+}
+
+// spanProcessorFactories create the extra span processors of every tracer provider
+var spanProcessorFactories []func() sdktrace.SpanProcessor
+
+// RegisterSpanProcessor adds a span processor to the tracer providers created by initOtel,
+// e.g. to scrub or enrich spans. It must be called before initOtel, typically from the
+// init function of a file compiled in with a build tag, see processors_example.go.
+//
+// The factory is called once per tracer provider as each one shuts its processors down.
+func RegisterSpanProcessor(factory func() sdktrace.SpanProcessor) {
+	spanProcessorFactories = append(spanProcessorFactories, factory)
+}
+
+// newTraceProvider create a trace provider fanning spans out to all exporters,
+// each with its own batch span processor so that a slow target does not hold back the others.
+// Extra processors run before the batch span processors.
+func newTraceProvider(exps []*otlptrace.Exporter, extra []sdktrace.SpanProcessor) *sdktrace.TracerProvider {
+	opts := []sdktrace.TracerProviderOption{
+		sdktrace.WithSpanProcessor(countingProcessor{queues: int64(len(exps))}),
+		sdktrace.WithResource(newResource()),
+	}
+	for _, p := range extra {
+		opts = append(opts, sdktrace.WithSpanProcessor(p))
+	}
+	for _, exp := range exps {
+		opts = append(opts, sdktrace.WithSpanProcessor(newBoundedProcessor(exp)))
+	}
+
+	return sdktrace.NewTracerProvider(opts...)
+}
+
+// newMeterController creates a push controller exporting metrics to target every
+// OtlpMetricsInterval, to the dataset of HONEYCOMB_METRICS_DATASET
+func newMeterController(ctx context.Context, target exportTarget) (*controller.Controller, error) {
+	opts := []otlpmetricgrpc.Option{
+		otlpmetricgrpc.WithHeaders(target.headersFor(HoneycombMetricsDataset)),
+		otlpmetricgrpc.WithRetry(otlpmetricgrpc.RetryConfig{
+			Enabled:         OtlpRetryEnabled,
+			InitialInterval: OtlpRetryInitialInterval,
+			MaxInterval:     OtlpRetryMaxInterval,
+			MaxElapsedTime:  OtlpRetryMaxElapsedTime,
+		}),
+	}
+	// with only OTEL_EXPORTER_OTLP_TRACES_ENDPOINT set, metrics still go to Honeycomb
+	// rather than to the SDK default of localhost
+	endpoint := target.Endpoint
+	if endpoint == "" && !OtelMetricsEndpointFromEnv {
+		endpoint = HoneycombEndPoint
+	}
+	if endpoint != "" {
+		opts = append(opts,
+			otlpmetricgrpc.WithEndpoint(endpoint),
+			otlpmetricgrpc.WithTLSCredentials(credentials.NewClientTLSFromCert(nil, "")),
+		)
+	}
+
+	exporter, err := otlpmetricgrpc.New(ctx, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	// build and job durations range from seconds to hours
+	boundaries := []float64{1, 5, 10, 30, 60, 120, 300, 600, 1200, 1800, 3600, 7200}
+	c := controller.New(
+		processor.NewFactory(
+			simple.NewWithHistogramDistribution(histogram.WithExplicitBoundaries(boundaries)),
+			aggregation.CumulativeTemporalitySelector(),
+		),
+		controller.WithExporter(exporter),
+		controller.WithCollectPeriod(OtlpMetricsInterval),
+		controller.WithResource(newResource()),
 	)
 
-	return sdktrace.NewTracerProvider(
-		sdktrace.WithBatcher(exp),
-		sdktrace.WithResource(res),
+	return c, c.Start(ctx)
+}
+
+// newDurationHistograms creates the build and job duration histograms, and the
+// export lag histogram, on meter
+func newDurationHistograms(meter metric.Meter) (metric.Float64Histogram, metric.Float64Histogram, metric.Float64Histogram, error) {
+	var none metric.Float64Histogram
+	builds, err := meter.NewFloat64Histogram("buildkite.build.duration",
+		metric.WithUnit(unit.Unit("s")),
+		metric.WithDescription("Duration of finished builds by pipeline and state"),
+	)
+	if err != nil {
+		return none, none, none, err
+	}
+
+	jobs, err := meter.NewFloat64Histogram("buildkite.job.duration",
+		metric.WithUnit(unit.Unit("s")),
+		metric.WithDescription("Duration of finished jobs by pipeline and state"),
+	)
+	if err != nil {
+		return none, none, none, err
+	}
+
+	lags, err := meter.NewFloat64Histogram("buildkite.export.lag",
+		metric.WithUnit(unit.Unit("s")),
+		metric.WithDescription("Time from builds finishing until they are exported by pipeline"),
 	)
+
+	return builds, jobs, lags, err
 }
 
 // newDebugTracerProvider creates a trace provider that will print all traces as
@@ -53,15 +338,135 @@ func newDebugTracerProvider() *sdktrace.TracerProvider {
 	return sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
 }
 
-// initOtel returns a tracer object and a function that help handler graceful shutdown
-func initOtel(ctx context.Context, serviceName string) (trace.Tracer, func()) {
-	// Init otel
-	exporter, err := newExporter(ctx)
-	if err != nil {
-		log.Fatalf("failed to initialize exporter: %v\n", err)
+// parseSpanKind converts a span kind name such as "server" into trace.SpanKind
+func parseSpanKind(kind string) trace.SpanKind {
+	switch strings.ToLower(kind) {
+	case "internal":
+		return trace.SpanKindInternal
+	case "server":
+		return trace.SpanKindServer
+	case "client":
+		return trace.SpanKindClient
+	case "producer":
+		return trace.SpanKindProducer
+	case "consumer":
+		return trace.SpanKindConsumer
+	default:
+		log.Fatalf("invalid span kind: %q\n", kind)
+	}
+
+	return trace.SpanKindUnspecified
+}
+
+// otelLogVerbosity maps OtelLogLevel to the logr verbosity the SDK logs its info
+// and debug messages at
+var otelLogVerbosity = map[string]int{"error": 0, "info": 1, "debug": 5}
+
+// initOtelLogging routes errors and internal logs of the OTel SDK, like dropped or
+// failed batches, to our logger at OtelLogLevel
+func initOtelLogging() {
+	if OtelLogLevel == "none" {
+		otel.SetLogger(logr.Discard())
+		otel.SetErrorHandler(otel.ErrorHandlerFunc(func(error) {}))
+		return
+	}
+
+	stdr.SetVerbosity(otelLogVerbosity[OtelLogLevel])
+	otel.SetLogger(stdr.New(log.Default()).WithName("otel"))
+	otel.SetErrorHandler(otel.ErrorHandlerFunc(func(err error) {
+		log.Printf("otel error: %v", err)
+	}))
+}
+
+// initOtel returns a tracer router and a function that help handler graceful shutdown.
+//
+// One tracer provider is created per dataset so that pipelines routed to the same
+// dataset share exporters, with one exporter per export target.
+func initOtel(ctx context.Context, serviceName string) (*tracerRouter, func()) {
+	initOtelLogging()
+
+	providers := make(map[string]*sdktrace.TracerProvider)
+	providerFor := func(dataset string) *sdktrace.TracerProvider {
+		if tp, ok := providers[dataset]; ok {
+			return tp
+		}
+
+		var exporters []*otlptrace.Exporter
+		for _, target := range ExportTargets {
+			exporter, err := newExporter(ctx, target, dataset)
+			if err != nil {
+				log.Fatalf("failed to initialize exporter to %s for dataset %s: %v\n", target.Endpoint, dataset, err)
+			}
+			exporters = append(exporters, exporter)
+		}
+
+		var extra []sdktrace.SpanProcessor
+		for _, factory := range spanProcessorFactories {
+			extra = append(extra, factory())
+		}
+
+		tp := newTraceProvider(exporters, extra)
+		providers[dataset] = tp
+		return tp
 	}
 
-	tp := newTraceProvider(exporter)
+	router := &tracerRouter{
+		defaultTracer:   providerFor("").Tracer(serviceName),
+		pipelineTracers: make(map[string]trace.Tracer),
+		internalTracer:  trace.NewNoopTracerProvider().Tracer(serviceName + ".internal"),
+	}
+	if SelfTrace {
+		router.internalTracer = providerFor("").Tracer(serviceName + ".internal")
+	}
+	for pipeline, dataset := range HoneycombPipelineDatasets {
+		router.pipelineTracers[pipeline] = providerFor(dataset).Tracer(serviceName)
+	}
 
-	return tp.Tracer(serviceName), func() { _ = tp.Shutdown(ctx) }
+	// metrics go to every export target like spans
+	var controllers []*controller.Controller
+	if OtlpMetricsEnabled {
+		for _, target := range ExportTargets {
+			c, err := newMeterController(ctx, target)
+			if err != nil {
+				log.Fatalf("failed to initialize metrics exporter to %s: %v\n", target.Endpoint, err)
+			}
+			controllers = append(controllers, c)
+
+			builds, jobs, lags, err := newDurationHistograms(c.Meter(serviceName))
+			if err != nil {
+				log.Fatalf("failed to create duration histograms: %v\n", err)
+			}
+			buildDurations = append(buildDurations, builds)
+			jobDurations = append(jobDurations, jobs)
+			exportLags = append(exportLags, lags)
+		}
+	}
+
+	return router, func() {
+		// bounded separately from the drain of build workers so that the final flush is not starved
+		ctx, cancel := context.WithTimeout(ctx, ShutdownFlushTimeout)
+		defer cancel()
+
+		// flushed before shutting down so that the flush span itself is exported by the shutdown
+		_, end := router.startCall(ctx, "flush", ShutdownFlushTimeout, attribute.Int("datasets", len(providers)))
+		var flushErr error
+		for dataset, tp := range providers {
+			if err := tp.ForceFlush(ctx); err != nil {
+				log.Printf("shutdown flush of dataset %q did not complete within %s: %v", dataset, ShutdownFlushTimeout, err)
+				flushErr = err
+			}
+		}
+		end(flushErr)
+
+		for dataset, tp := range providers {
+			if err := tp.Shutdown(ctx); err != nil {
+				log.Printf("shutdown of dataset %q did not complete within %s: %v", dataset, ShutdownFlushTimeout, err)
+			}
+		}
+		for _, c := range controllers {
+			if err := c.Stop(ctx); err != nil {
+				log.Printf("shutdown flush of metrics did not complete within %s: %v", ShutdownFlushTimeout, err)
+			}
+		}
+	}
 }
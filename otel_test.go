@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/pem"
+	"net"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+)
+
+// otlpReceiver is an OTLP gRPC trace receiver recording the metadata of the exports it receives
+type otlpReceiver struct {
+	coltracepb.UnimplementedTraceServiceServer
+
+	mu      sync.Mutex
+	exports []metadata.MD
+}
+
+func (r *otlpReceiver) Export(ctx context.Context, _ *coltracepb.ExportTraceServiceRequest) (*coltracepb.ExportTraceServiceResponse, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.exports = append(r.exports, md)
+
+	return &coltracepb.ExportTraceServiceResponse{}, nil
+}
+
+// startTLSReceiver serves an otlpReceiver over TLS on a local port, returning its address.
+//
+// The exporter verifies the receiver against the system roots, so the receiver's
+// self-signed certificate is made the only system root through SSL_CERT_FILE. This
+// relies on the system roots not being loaded by the test binary before.
+func startTLSReceiver(t *testing.T) (*otlpReceiver, string) {
+	t.Helper()
+
+	// httptest's certificate is valid for 127.0.0.1
+	https := httptest.NewTLSServer(nil)
+	cert := https.TLS.Certificates[0]
+	leaf := https.Certificate()
+	https.Close()
+
+	roots := filepath.Join(t.TempDir(), "roots.pem")
+	if err := os.WriteFile(roots, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: leaf.Raw}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("SSL_CERT_FILE", roots)
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	receiver := &otlpReceiver{}
+	server := grpc.NewServer(grpc.Creds(credentials.NewTLS(&tls.Config{Certificates: []tls.Certificate{cert}})))
+	coltracepb.RegisterTraceServiceServer(server, receiver)
+	go server.Serve(lis)
+	t.Cleanup(server.Stop)
+
+	return receiver, lis.Addr().String()
+}
+
+func TestNewExporterTLSAndHeaders(t *testing.T) {
+	receiver, addr := startTLSReceiver(t)
+	ctx := context.Background()
+
+	target := exportTarget{
+		Endpoint: addr,
+		Headers: map[string]string{
+			"x-honeycomb-team":    "api-key",
+			"x-honeycomb-dataset": "default",
+		},
+	}
+	exp, err := newExporter(ctx, target, "buildkite")
+	if err != nil {
+		t.Fatalf("newExporter: %v", err)
+	}
+	defer exp.Shutdown(ctx)
+
+	if err := exp.ExportSpans(ctx, tracetest.SpanStubs{{Name: "build"}}.Snapshots()); err != nil {
+		t.Fatalf("ExportSpans over TLS: %v", err)
+	}
+
+	receiver.mu.Lock()
+	defer receiver.mu.Unlock()
+	if len(receiver.exports) != 1 {
+		t.Fatalf("receiver got %d exports, want 1", len(receiver.exports))
+	}
+	md := receiver.exports[0]
+	for key, want := range map[string]string{
+		"x-honeycomb-team":    "api-key",
+		"x-honeycomb-dataset": "buildkite",
+	} {
+		if got := md.Get(key); !reflect.DeepEqual(got, []string{want}) {
+			t.Errorf("header %s = %q, want %q", key, got, want)
+		}
+	}
+}
+
+func TestExportTargetHeadersFor(t *testing.T) {
+	target := exportTarget{Headers: map[string]string{
+		"x-honeycomb-team":    "api-key",
+		"x-honeycomb-dataset": "default",
+	}}
+
+	tests := []struct {
+		dataset string
+		want    map[string]string
+	}{
+		{"", map[string]string{"x-honeycomb-team": "api-key", "x-honeycomb-dataset": "default"}},
+		{"buildkite", map[string]string{"x-honeycomb-team": "api-key", "x-honeycomb-dataset": "buildkite"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.dataset, func(t *testing.T) {
+			if got := target.headersFor(tt.dataset); !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("headersFor(%q) = %v, want %v", tt.dataset, got, tt.want)
+			}
+		})
+	}
+
+	if target.Headers["x-honeycomb-dataset"] != "default" {
+		t.Fatalf("headersFor modified the target headers: %v", target.Headers)
+	}
+}
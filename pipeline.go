@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/buildkite/go-buildkite/v3/buildkite"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// pipelineEntry is a lookup of a pipeline shared by the build goroutines which need it,
+// its fields are set before done is closed
+type pipelineEntry struct {
+	done      chan struct{}
+	fetchedAt time.Time
+
+	detail *buildkite.Pipeline
+	teams  []string
+	err    error
+}
+
+// lookupPipeline returns the entry of the pipeline in entries, calling fetch to fill it
+// when missing or older than PipelineCacheTTL. Failures are kept like successes so that
+// a failing pipeline is not fetched again by every build. Only one goroutine fetches
+// a pipeline at a time, the others wait for its entry without holding pipelineMu.
+func (d *daemon) lookupPipeline(entries map[string]*pipelineEntry, pipeline string, fetch func(e *pipelineEntry)) *pipelineEntry {
+	d.pipelineMu.Lock()
+	e, ok := entries[pipeline]
+	if ok {
+		select {
+		case <-e.done:
+			ok = time.Since(e.fetchedAt) < PipelineCacheTTL
+		default:
+		}
+	}
+	if ok {
+		d.pipelineMu.Unlock()
+		<-e.done
+		return e
+	}
+
+	e = &pipelineEntry{done: make(chan struct{})}
+	entries[pipeline] = e
+	d.pipelineMu.Unlock()
+
+	defer close(e.done)
+	defer func() { e.fetchedAt = time.Now() }()
+	fetch(e)
+
+	return e
+}
+
+// pipelineDetail returns the details of a pipeline, only calling BuildKite API
+// once per PipelineCacheTTL
+func (d *daemon) pipelineDetail(ctx context.Context, pipeline string) (*buildkite.Pipeline, error) {
+	e := d.lookupPipeline(d.pipelineDetails, pipeline, func(e *pipelineEntry) {
+		d.apiLimit <- struct{}{}
+		defer func() { <-d.apiLimit }()
+
+		_, end := d.tracer.startCall(selfContext(ctx), "GetPipeline", BuildKiteRequestTimeout, attribute.String("pipeline", pipeline))
+		e.detail, _, e.err = d.buildKite.Pipelines.Get(BuildKiteOrgName, pipeline)
+		end(e.err)
+		if e.err != nil {
+			e.err = fmt.Errorf("error fetching pipeline %s: %v", pipeline, e.err)
+		}
+	})
+
+	return e.detail, e.err
+}
+
+// defaultBranch returns the default branch of a pipeline
+func (d *daemon) defaultBranch(ctx context.Context, pipeline string) (string, error) {
+	p, err := d.pipelineDetail(ctx, pipeline)
+	if err != nil || p.DefaultBranch == nil {
+		return "", err
+	}
+
+	return *p.DefaultBranch, nil
+}
+
+// repository returns the repository URL of a pipeline
+func (d *daemon) repository(ctx context.Context, pipeline string) (string, error) {
+	p, err := d.pipelineDetail(ctx, pipeline)
+	if err != nil || p.Repository == nil {
+		return "", err
+	}
+
+	return *p.Repository, nil
+}
+
+// pipelineID returns the ID of a pipeline, which is kept when the pipeline is renamed
+func (d *daemon) pipelineID(ctx context.Context, pipeline string) (string, error) {
+	p, err := d.pipelineDetail(ctx, pipeline)
+	if err != nil || p.ID == nil {
+		return "", err
+	}
+
+	return *p.ID, nil
+}
+
+// team returns the owning team of a pipeline, the first of its teams in GraphQL API,
+// falling back to DefaultTeam. Teams are only fetched once per PipelineCacheTTL.
+func (d *daemon) team(ctx context.Context, pipeline string) (string, error) {
+	if !BuildKiteGraphQLEnabled {
+		return DefaultTeam, nil
+	}
+
+	e := d.lookupPipeline(d.pipelineTeams, pipeline, func(e *pipelineEntry) {
+		d.apiLimit <- struct{}{}
+		defer func() { <-d.apiLimit }()
+
+		callCtx, end := d.tracer.startCall(selfContext(ctx), "GraphQL", BuildKiteRequestTimeout, attribute.String("query", "pipeline_teams"))
+		e.teams, e.err = fetchPipelineTeams(callCtx, pipeline)
+		end(e.err)
+		if e.err != nil {
+			e.err = fmt.Errorf("error fetching teams of pipeline %s: %v", pipeline, e.err)
+		}
+	})
+	if e.err != nil {
+		return DefaultTeam, e.err
+	}
+
+	if len(e.teams) == 0 {
+		return DefaultTeam, nil
+	}
+
+	return e.teams[0], nil
+}
+
+// withClusterPipelines adds the pipelines of BuildKiteCluster to pipelines,
+// keeping the last resolved pipelines when listing them fails
+func (d *daemon) withClusterPipelines(pipelines []string) []string {
+	if time.Since(d.clusterResolvedAt) >= BuildKiteClusterRefresh {
+		resolved, err := d.listClusterPipelines()
+		if err != nil {
+			log.Printf("error listing pipelines of cluster %s: %v", BuildKiteCluster, err)
+		} else {
+			d.clusterPipelines = resolved
+			d.clusterResolvedAt = time.Now()
+			log.Printf("cluster %s has %d pipelines", BuildKiteCluster, len(resolved))
+		}
+	}
+
+	result := append([]string{}, pipelines...)
+	for _, p := range d.clusterPipelines {
+		if !contains(result, p) {
+			result = append(result, p)
+		}
+	}
+
+	return result
+}
+
+// listClusterPipelines returns the slugs of the pipelines in BuildKiteCluster.
+// BuildKite API cannot filter pipelines by cluster so all pipelines of the org are listed.
+func (d *daemon) listClusterPipelines() ([]string, error) {
+	opts := &buildkite.PipelineListOptions{
+		ListOptions: buildkite.ListOptions{
+			Page:    1,
+			PerPage: BuildKiteMaxPagination,
+		},
+	}
+
+	var result []string
+	for {
+		pipelines, resp, err := d.buildKite.Pipelines.List(BuildKiteOrgName, opts)
+		if err != nil {
+			return nil, fmt.Errorf("error listing pipelines on page %d: %v", opts.Page, err)
+		}
+
+		for _, p := range pipelines {
+			if p.ClusterID != nil && *p.ClusterID == BuildKiteCluster && p.Slug != nil {
+				result = append(result, *p.Slug)
+			}
+		}
+
+		if resp.NextPage == 0 || resp.NextPage <= opts.Page || (BuildKiteMaxPages > 0 && opts.Page >= BuildKiteMaxPages) {
+			return result, nil
+		}
+		opts.Page = resp.NextPage
+	}
+}
+
+// fetchBuildDetail enriches a listed build with the complete job list and metadata
+// from the single build endpoint
+func (d *daemon) fetchBuildDetail(ctx context.Context, b *buildkite.Build) error {
+	if b.Number == nil || b.Pipeline == nil || b.Pipeline.Slug == nil {
+		return fmt.Errorf("build %s has no number or pipeline", buildName(*b))
+	}
+
+	d.apiLimit <- struct{}{}
+	defer func() { <-d.apiLimit }()
+
+	_, end := d.tracer.startCall(selfContext(ctx), "GetBuild", BuildKiteRequestTimeout, attribute.String("pipeline", *b.Pipeline.Slug), attribute.Int("number", *b.Number))
+	detail, _, err := d.buildKite.Builds.Get(BuildKiteOrgName, *b.Pipeline.Slug, fmt.Sprintf("%d", *b.Number), nil)
+	end(err)
+	if err != nil {
+		return err
+	}
+
+	if len(detail.Jobs) > len(b.Jobs) {
+		b.Jobs = detail.Jobs
+	}
+	if detail.MetaData != nil {
+		b.MetaData = detail.MetaData
+	}
+
+	return nil
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/buildkite/go-buildkite/v3/buildkite"
+)
+
+func TestFetchBuildDetail(t *testing.T) {
+	start := time.Now().UTC().Truncate(time.Second)
+	jobs := testJobs(3, start, start.Add(time.Minute))
+
+	tests := []struct {
+		name   string
+		listed int
+		detail int
+		want   int
+	}{
+		{"truncated list", 1, 3, 3},
+		{"complete list", 3, 3, 3},
+		{"fewer jobs in detail", 3, 2, 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := testBuild("app", "b1", 1, start, start.Add(time.Minute))
+			b.Jobs = jobs[:tt.listed]
+			api := &fakeBuildKite{
+				builds: map[string][]buildkite.Build{"app": {b}},
+				jobs:   map[string][]*buildkite.Job{"app/1": jobs[:tt.detail]},
+			}
+			d, _ := newTestDaemon(t, api)
+
+			if err := d.fetchBuildDetail(context.Background(), &b); err != nil {
+				t.Fatalf("fetchBuildDetail: %v", err)
+			}
+			if len(b.Jobs) != tt.want {
+				t.Fatalf("build has %d jobs, want %d", len(b.Jobs), tt.want)
+			}
+		})
+	}
+}
+
+func TestPipelineDetailFetchesOncePerTTL(t *testing.T) {
+	var mu sync.Mutex
+	var calls int
+	failing := true
+	api := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		calls++
+		if failing {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprint(w, `{"slug": "app", "default_branch": "main"}`)
+	})
+	d, _ := newTestDaemon(t, api)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := d.pipelineDetail(context.Background(), "app"); err == nil {
+				t.Errorf("pipelineDetail succeeded on a failing API")
+			}
+		}()
+	}
+	wg.Wait()
+	if calls != 1 {
+		t.Fatalf("API called %d times, want once with the failure reused", calls)
+	}
+
+	ttl := PipelineCacheTTL
+	PipelineCacheTTL = 0
+	t.Cleanup(func() { PipelineCacheTTL = ttl })
+
+	mu.Lock()
+	failing = false
+	mu.Unlock()
+	if branch, err := d.defaultBranch(context.Background(), "app"); err != nil || branch != "main" {
+		t.Fatalf("defaultBranch() = %q, %v after the TTL, want main", branch, err)
+	}
+	if calls != 2 {
+		t.Fatalf("API called %d times, want again after the TTL", calls)
+	}
+}
+
+func TestTeamFetchesOnce(t *testing.T) {
+	var calls int64
+	graphql := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&calls, 1)
+		fmt.Fprint(w, `{"data": {"pipeline": {"teams": {"edges": [{"node": {"team": {"slug": "platform"}}}]}}}}`)
+	}))
+	defer graphql.Close()
+
+	enabled, endpoint := BuildKiteGraphQLEnabled, BuildKiteGraphQLEndPoint
+	BuildKiteGraphQLEnabled, BuildKiteGraphQLEndPoint = true, graphql.URL
+	t.Cleanup(func() { BuildKiteGraphQLEnabled, BuildKiteGraphQLEndPoint = enabled, endpoint })
+
+	d, _ := newTestDaemon(t, http.NotFoundHandler())
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if team, err := d.team(context.Background(), "app"); err != nil || team != "platform" {
+				t.Errorf("team() = %q, %v, want platform", team, err)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := atomic.LoadInt64(&calls); n != 1 {
+		t.Fatalf("GraphQL API called %d times, want once", n)
+	}
+}
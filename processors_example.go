@@ -0,0 +1,29 @@
+//go:build example
+// +build example
+
+package main
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+// This file shows how to plug a custom span processor into the exporter without forking it.
+// It is only compiled with `go build -tags example`.
+func init() {
+	RegisterSpanProcessor(func() sdktrace.SpanProcessor {
+		return exampleProcessor{}
+	})
+}
+
+// exampleProcessor tags every span when it starts, while attributes are still writable
+type exampleProcessor struct{}
+
+func (exampleProcessor) OnStart(_ context.Context, s sdktrace.ReadWriteSpan) {
+	s.SetAttributes(attribute.String("processed_by", "example"))
+}
+func (exampleProcessor) OnEnd(sdktrace.ReadOnlySpan)      {}
+func (exampleProcessor) Shutdown(context.Context) error   { return nil }
+func (exampleProcessor) ForceFlush(context.Context) error { return nil }
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// rebuiltFromBuild is the subset of a build payload describing its rebuild origin.
+// go-buildkite does not decode the `rebuilt_from` field so it is fetched separately.
+type rebuiltFromBuild struct {
+	RebuiltFrom *struct {
+		ID     string `json:"id"`
+		Number int    `json:"number"`
+	} `json:"rebuilt_from"`
+}
+
+// rebuildDepthLimit caps BuildRebuildMaxDepth, as every build exported walks its chain
+const rebuildDepthLimit = 20
+
+// rebuildDepth walks the rebuild chain of a build and returns how many times it was rebuilt,
+// bounded by BuildRebuildMaxDepth lookups, at most rebuildDepthLimit
+func (d *daemon) rebuildDepth(ctx context.Context, pipeline string, buildNumber int) (int, error) {
+	maxDepth := BuildRebuildMaxDepth
+	if maxDepth > rebuildDepthLimit {
+		maxDepth = rebuildDepthLimit
+	}
+
+	depth := 0
+	for depth < maxDepth {
+		b, err := d.rebuiltFrom(ctx, pipeline, buildNumber)
+		if err != nil {
+			return depth, err
+		}
+		if b.RebuiltFrom == nil {
+			break
+		}
+
+		depth++
+		buildNumber = b.RebuiltFrom.Number
+	}
+
+	return depth, nil
+}
+
+// rebuiltFrom fetches the rebuild origin of a build
+func (d *daemon) rebuiltFrom(ctx context.Context, pipeline string, buildNumber int) (rebuiltFromBuild, error) {
+	d.apiLimit <- struct{}{}
+	defer func() { <-d.apiLimit }()
+
+	var b rebuiltFromBuild
+	u := fmt.Sprintf("v2/organizations/%s/pipelines/%s/builds/%d", BuildKiteOrgName, pipeline, buildNumber)
+	req, err := d.buildKite.NewRequest("GET", u, nil)
+	if err != nil {
+		return b, fmt.Errorf("error creating build request: %v", err)
+	}
+
+	_, end := d.tracer.startCall(selfContext(ctx), "RebuiltFrom", BuildKiteRequestTimeout, attribute.String("pipeline", pipeline), attribute.Int("number", buildNumber))
+	_, err = d.buildKite.Do(req, &b)
+	end(err)
+	if err != nil {
+		return b, fmt.Errorf("error fetching build %d: %v", buildNumber, err)
+	}
+
+	return b, nil
+}
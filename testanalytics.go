@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// testExecution is a single execution of a test in a Test Analytics run, as returned
+// by the executions endpoint of the run.
+//
+// Runs uploaded by the BuildKite test collectors are keyed by the build ID, and each
+// execution carries the ID of the job which uploaded it.
+//
+// reference: https://buildkite.com/docs/apis/rest-api/analytics/runs
+type testExecution struct {
+	TestID string `json:"test_id"`
+	JobID  string `json:"job_id"`
+	Result string `json:"result"`
+}
+
+// testCounts summarizes the tests run by a job
+type testCounts struct {
+	Passed, Failed, Flaky int
+}
+
+// testExecutionsPerPage is the page size of the executions endpoint
+const testExecutionsPerPage = 100
+
+// jobTestCounts returns the test counts of each job of the build, keyed by job ID.
+//
+// A test with both passed and failed executions in a job, i.e. retried by the test
+// framework, is counted as flaky rather than as passed or failed.
+func (d *daemon) jobTestCounts(ctx context.Context, buildID string) (map[string]testCounts, error) {
+	results := make(map[string]map[string]map[string]bool)
+	for page := 1; BuildKiteMaxPages == 0 || page <= BuildKiteMaxPages; page++ {
+		executions, err := d.fetchTestExecutions(ctx, buildID, page)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, e := range executions {
+			if e.JobID == "" {
+				continue
+			}
+			if results[e.JobID] == nil {
+				results[e.JobID] = make(map[string]map[string]bool)
+			}
+			if results[e.JobID][e.TestID] == nil {
+				results[e.JobID][e.TestID] = make(map[string]bool)
+			}
+			results[e.JobID][e.TestID][e.Result] = true
+		}
+
+		if len(executions) < testExecutionsPerPage {
+			break
+		}
+	}
+
+	counts := make(map[string]testCounts, len(results))
+	for jobID, tests := range results {
+		var c testCounts
+		for _, seen := range tests {
+			switch {
+			case seen["passed"] && seen["failed"]:
+				c.Flaky++
+			case seen["failed"]:
+				c.Failed++
+			case seen["passed"]:
+				c.Passed++
+			}
+		}
+		counts[jobID] = c
+	}
+
+	return counts, nil
+}
+
+// fetchTestExecutions returns a page of the test executions of the build's run in
+// the configured suite. A build without a run has no executions.
+func (d *daemon) fetchTestExecutions(ctx context.Context, buildID string, page int) ([]testExecution, error) {
+	d.apiLimit <- struct{}{}
+	defer func() { <-d.apiLimit }()
+
+	u := fmt.Sprintf(
+		"%sv2/analytics/organizations/%s/suites/%s/runs/%s/executions?page=%d&per_page=%d",
+		TestAnalyticsEndPoint,
+		url.PathEscape(BuildKiteOrgName),
+		url.PathEscape(TestAnalyticsSuite),
+		url.PathEscape(buildID),
+		page,
+		testExecutionsPerPage,
+	)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error creating test analytics request: %v", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+TestAnalyticsToken)
+	req.Header.Set("User-Agent", BuildKiteUserAgent)
+
+	_, end := d.tracer.startCall(selfContext(ctx), "ListTestExecutions", BuildKiteRequestTimeout, attribute.String("build_id", buildID), attribute.Int("page", page))
+	resp, err := apiClient.Do(req)
+	end(err)
+	if err != nil {
+		return nil, fmt.Errorf("error calling test analytics api: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected test analytics status: %s", resp.Status)
+	}
+
+	var executions []testExecution
+	if err := json.NewDecoder(resp.Body).Decode(&executions); err != nil {
+		return nil, fmt.Errorf("error decoding test analytics response: %v", err)
+	}
+
+	return executions, nil
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/buildkite/go-buildkite/v3/buildkite"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// unblockedJobs is the subset of a build payload describing when block steps were unblocked.
+// go-buildkite does not decode the `unblocked_at` field so it is fetched separately.
+type unblockedJobs struct {
+	Jobs []struct {
+		ID          string               `json:"id"`
+		UnblockedAt *buildkite.Timestamp `json:"unblocked_at"`
+	} `json:"jobs"`
+}
+
+// isUnblocked reports whether the job is a block step that was unblocked by someone
+func isUnblocked(j *buildkite.Job) bool {
+	return j.Type != nil && *j.Type == "manual" && j.UnblockedBy != nil
+}
+
+// hasUnblockedJob reports whether any block step of the build was unblocked
+func hasUnblockedJob(b buildkite.Build) bool {
+	for _, j := range b.Jobs {
+		if isUnblocked(j) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// unblockTimes returns when each unblocked block step of a build was unblocked, keyed by job ID
+func (d *daemon) unblockTimes(ctx context.Context, pipeline string, buildNumber int) (map[string]time.Time, error) {
+	d.apiLimit <- struct{}{}
+	defer func() { <-d.apiLimit }()
+
+	u := fmt.Sprintf("v2/organizations/%s/pipelines/%s/builds/%d", BuildKiteOrgName, pipeline, buildNumber)
+	req, err := d.buildKite.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error creating build request: %v", err)
+	}
+
+	var b unblockedJobs
+	_, end := d.tracer.startCall(selfContext(ctx), "UnblockedAt", BuildKiteRequestTimeout, attribute.String("pipeline", pipeline), attribute.Int("number", buildNumber))
+	_, err = d.buildKite.Do(req, &b)
+	end(err)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching build %d: %v", buildNumber, err)
+	}
+
+	result := make(map[string]time.Time)
+	for _, j := range b.Jobs {
+		if j.UnblockedAt != nil {
+			result[j.ID] = j.UnblockedAt.Time
+		}
+	}
+
+	return result, nil
+}
+
+// blockedDuration sums the time the block steps of a build waited to be unblocked,
+// from when they became runnable until someone unblocked them
+func blockedDuration(jobs []*buildkite.Job, unblockedAt map[string]time.Time) time.Duration {
+	var total time.Duration
+	for _, j := range jobs {
+		if !isUnblocked(j) || j.ID == nil {
+			continue
+		}
+		unblocked, ok := unblockedAt[*j.ID]
+		blockedAt := firstTimestamp(j.RunnableAt, j.CreatedAt)
+		if !ok || blockedAt == nil || unblocked.Before(blockedAt.Time) {
+			continue
+		}
+		total += unblocked.Sub(blockedAt.Time)
+	}
+
+	return total
+}